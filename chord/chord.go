@@ -0,0 +1,325 @@
+package chord
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Options configures a node created by NewNode
+type Options struct {
+	IpAddress        string            //The host that the node binds to, "localhost", "0.0.0.0", "::", an IPv4 or IPv6 address, or a DNS name
+	Port             int               //The port that the node binds to and listens on
+	AdvertiseIp      string            //The host that the other nodes use to reach the node, derived from IpAddress and NAT if it is empty
+	AdvertisePort    int               //The port that the other nodes use to reach the node, Port if it is 0
+	NAT              map[string]string //The static mapping from private to public addresses, see LoadNATFile
+	Ts               time.Duration     //The time between invocations of stabilize
+	Tff              time.Duration     //The time between invocations of fix fingers
+	Tcp              time.Duration     //The time between invocations of check predecessor
+	Tae              time.Duration     //The time between invocations of anti-entropy, which repairs the backups of the successors
+	TombstoneTTL     time.Duration     //How long a deleted file is remembered at least, its tombstone is dropped after that once every replica has it
+	TransferTTL      time.Duration     //How long an unfinished transfer is kept without getting a chunk, it is removed with its partial file after that
+	R                int               //The number of successors maintained by the node
+	Replicas         int               //The number of successors holding a backup of every file, at most R, 1 by default
+	M                int               //The identifier bit-width of the Chord ring, at most MaxIdentifierBits
+	ClientName       string            //The name of the node, the address is used if it is empty
+	Identifier       *big.Int          //The identifier of the node, reduced modulo 2^M, the SHA-1 sum of the address is used if it is nil
+	StorageRoot      string            //The folder that holds the folders of the nodes, "../files" by default
+	Backoff          int               //The delays of the tasks grow up to Backoff times Ts, Tff and Tcp while the ring is stable
+	Jitter           float64           //The delays of the tasks are randomized by ±Jitter of themselves, a negative value disables it
+	LookupMode       LookupMode        //How the node finds the successor of a key, RecursiveLookup by default
+	ReadConsistency  Consistency       //How many copies Get waits for, ConsistencyOne by default
+	WriteConsistency Consistency       //How many copies Put waits for, ConsistencyOne by default
+	JoinAttempts     int               //The number of rounds over the seeds before Start gives up joining
+	JoinBackoff      time.Duration     //The wait after the first round that failed, doubled after every round
+	Transport        Transport         //Carries the RPCs of the node, a TCPTransport with the default timeouts owned by the node if it is nil
+}
+
+// DefaultOptions are the options of the command line client
+func DefaultOptions() Options {
+	return Options{
+		IpAddress:    "localhost",
+		Port:         8080,
+		Ts:           3000 * time.Millisecond,
+		Tff:          3000 * time.Millisecond,
+		Tcp:          100 * time.Millisecond,
+		Tae:          3000 * time.Millisecond,
+		TombstoneTTL: 10 * time.Minute,
+		TransferTTL:  10 * time.Minute,
+		R:            3,
+		Replicas:     1,
+		M:            6,
+		StorageRoot:  "../files",
+		Backoff:      8,
+		Jitter:       0.2,
+		JoinAttempts: 5,
+		JoinBackoff:  500 * time.Millisecond,
+	}
+}
+
+// setDefaults fills the options that are not set with DefaultOptions
+func (options *Options) setDefaults() {
+	defaults := DefaultOptions()
+	if options.IpAddress == "" {
+		options.IpAddress = defaults.IpAddress
+	}
+	if options.Ts <= 0 {
+		options.Ts = defaults.Ts
+	}
+	if options.Tff <= 0 {
+		options.Tff = defaults.Tff
+	}
+	if options.Tcp <= 0 {
+		options.Tcp = defaults.Tcp
+	}
+	if options.Tae <= 0 {
+		options.Tae = defaults.Tae
+	}
+	if options.TombstoneTTL <= 0 {
+		options.TombstoneTTL = defaults.TombstoneTTL
+	}
+	if options.TransferTTL <= 0 {
+		options.TransferTTL = defaults.TransferTTL
+	}
+	if options.R <= 0 {
+		options.R = defaults.R
+	}
+	if options.Replicas <= 0 {
+		options.Replicas = defaults.Replicas
+	}
+	if options.Replicas > options.R {
+		options.Replicas = options.R
+	}
+	if options.M <= 0 {
+		options.M = defaults.M
+	}
+	if options.StorageRoot == "" {
+		options.StorageRoot = defaults.StorageRoot
+	}
+	if options.Backoff <= 0 {
+		options.Backoff = defaults.Backoff
+	}
+	if options.Jitter == 0 {
+		options.Jitter = defaults.Jitter
+	}
+	if options.JoinAttempts <= 0 {
+		options.JoinAttempts = defaults.JoinAttempts
+	}
+	if options.JoinBackoff <= 0 {
+		options.JoinBackoff = defaults.JoinBackoff
+	}
+}
+
+// advertiseAddr returns the host:port that the node gives to the other nodes
+// a node bound to all interfaces advertises the address of one of them, no outside service is asked
+func (options *Options) advertiseAddr() string {
+	port := strconv.Itoa(options.Port)
+	if options.AdvertisePort != 0 {
+		port = strconv.Itoa(options.AdvertisePort)
+	}
+	if options.AdvertiseIp != "" {
+		return net.JoinHostPort(options.AdvertiseIp, port)
+	}
+	host := options.IpAddress
+	ip := net.ParseIP(host)
+	if host == "localhost" {
+		host = "127.0.0.1"
+	} else if ip != nil && ip.IsUnspecified() {
+		host = localAddress()
+	} else if ip != nil {
+		host = ip.String()
+	}
+	// a DNS name is given to the other nodes as it is, they resolve it when they dial
+	addr := natAddress(options.NAT, net.JoinHostPort(host, strconv.Itoa(options.Port)))
+	if options.AdvertisePort != 0 {
+		host, _, _ = net.SplitHostPort(addr)
+		addr = net.JoinHostPort(host, port)
+	}
+	return addr
+}
+
+// listenAddr returns the address that the node serves its RPCs at, see Transport.ListenAddr
+func (node *Node) listenAddr() string {
+	return node.transport.ListenAddr(net.JoinHostPort(node.options.IpAddress, strconv.Itoa(node.options.Port)), node.Addr)
+}
+
+// ErrNoSeedReachable is returned by Start when the node could not join the Chord through any seed
+var ErrNoSeedReachable = errors.New("no seed node is reachable")
+
+// ErrJoinNotVerified is returned by Start when a seed answered, but the successor it found did not take the node in
+var ErrJoinNotVerified = errors.New("the join could not be verified")
+
+// ErrJoinRefused is returned by Start when a seed refused the node, e.g. its identifier is already used
+// joining again through another seed would not help
+var ErrJoinRefused = errors.New("the Chord refused the node")
+
+// Start serves the RPCs of the node and joins the Chord through the first seed that lets it in
+// the seeds are tried in order, JoinAttempts times with a backoff between the rounds
+// if no seed is given, a restarted node rejoins the Chord it was part of, otherwise a new Chord is created
+// the stabilization tasks run in the background until Stop is called
+func (node *Node) Start(seeds ...string) error {
+	if node.listener != nil {
+		return errors.New("the node " + node.Addr + " is already started")
+	}
+	listener, err := ServeNode(node.transport, node, node.listenAddr())
+	if err != nil {
+		return err
+	}
+	node.listener = listener
+
+	var joinAddrs []string
+	for _, seed := range seeds {
+		if seed != "" && seed != node.Addr {
+			joinAddrs = append(joinAddrs, seed)
+		}
+	}
+
+	if len(joinAddrs) > 0 {
+		// Join the existing chord
+		err = node.joinSeeds(joinAddrs, node.options.JoinAttempts)
+		if err != nil {
+			node.listener.Close()
+			node.listener = nil
+			return err
+		}
+	} else if node.hasKnownNodes() {
+		// The node is restarted, rejoin the chord it was part of
+		err = node.rejoinChord()
+		if err != nil {
+			log.Println("[Start] Failed to rejoin the Chord, create a new one:", err.Error())
+			node.createNewChord()
+		}
+	} else {
+		// Create new chord
+		node.createNewChord()
+	}
+
+	executorStabilization := NewScheduledExecutor("stabilize", node.options.Ts, node.options.Backoff, node.options.Jitter)
+	executorFixFinger := NewScheduledExecutor("fixFingers", node.options.Tff, node.options.Backoff, node.options.Jitter)
+	executorCheckPredecessor := NewScheduledExecutor("checkPredecessor", node.options.Tcp, node.options.Backoff, node.options.Jitter)
+	executorAntiEntropy := NewScheduledExecutor("antiEntropy", node.options.Tae, node.options.Backoff, node.options.Jitter)
+	executorHandBack := NewScheduledExecutor("handBack", node.options.Tae, node.options.Backoff, node.options.Jitter)
+	// the sweep does not depend on the ring, it runs at a fixed pace
+	executorSweep := NewScheduledExecutor("sweepTransfers", node.options.TransferTTL/2, 1, node.options.Jitter)
+	node.mutex.Lock()
+	node.executors = []*ScheduledExecutor{executorStabilization, executorFixFinger, executorCheckPredecessor, executorAntiEntropy, executorHandBack, executorSweep}
+	node.mutex.Unlock()
+	executorStabilization.Start(node.stabilize, node.membershipChanges)
+	executorFixFinger.Start(node.FixFingers, node.membershipChanges)
+	executorCheckPredecessor.Start(node.checkPredecessor, node.membershipChanges)
+	executorAntiEntropy.Start(node.antiEntropy, node.membershipChanges)
+	executorHandBack.Start(node.handBack, node.membershipChanges)
+	executorSweep.Start(node.sweepTransfers, node.membershipChanges)
+	return nil
+}
+
+// Stop leaves the Chord gracefully and shuts the node down
+// the files of the node are handed over to its successor, the error tells if that failed
+func (node *Node) Stop() error {
+	if node.listener == nil {
+		return errors.New("the node " + node.Addr + " is not started")
+	}
+	node.mutex.Lock()
+	executors := node.executors
+	node.executors = nil
+	node.mutex.Unlock()
+	for _, executor := range executors {
+		executor.Stop()
+	}
+	// hand over the files and link the neighbours before the listener is shut down
+	err := node.leaveChord()
+	node.saveState()
+	node.listener.Close()
+	node.listener = nil
+	if node.ownTransport {
+		node.transport.Close()
+	}
+	return err
+}
+
+// Lookup returns the address of the node responsible for the key, with the lookup mode of the options
+func (node *Node) Lookup(key string) (string, error) {
+	return node.LookupWithMode(key, node.options.LookupMode)
+}
+
+// LookupWithMode returns the address of the node responsible for the key, with the given lookup mode
+func (node *Node) LookupWithMode(key string, mode LookupMode) (string, error) {
+	trace, err := node.TraceWithMode(key, mode)
+	return trace.Successor, err
+}
+
+// Trace looks the key up like Lookup, and returns every node the lookup went through
+func (node *Node) Trace(key string) (LookupTrace, error) {
+	return node.TraceWithMode(key, node.options.LookupMode)
+}
+
+// TraceWithMode looks the key up like LookupWithMode, and returns every node the lookup went through
+func (node *Node) TraceWithMode(key string, mode LookupMode) (LookupTrace, error) {
+	id := StrHash(key)
+	var trace LookupTrace
+	var err error
+	if mode == IterativeLookup {
+		trace, err = node.traceIterative(id)
+	} else {
+		trace = node.lookupRecursive(id, node.Addr)
+	}
+	trace.Id = id.Mod(id, node.HashMod)
+	if err == nil && trace.Successor == "" {
+		err = errors.New("no node is found for the key " + key)
+	}
+	return trace, err
+}
+
+// Put stores the content read from content as the file in the Chord, with the WriteConsistency of the options
+func (node *Node) Put(fileName string, content io.Reader) error {
+	return StoreFile(fileName, node, content)
+}
+
+// PutWithConsistency stores the file like Put, and returns how many copies acknowledged the write
+// the new version replaces the versions of the file that the node has read or written before
+func (node *Node) PutWithConsistency(fileName string, content io.Reader, consistency Consistency) (int, error) {
+	return StoreFileWithConsistency(fileName, node, content, consistency)
+}
+
+// PutWithContext stores the file like PutWithConsistency, the new version replaces the versions that the
+// context descends, e.g. MergeClocks of the siblings returned by GetSiblings once the caller has merged them
+func (node *Node) PutWithContext(fileName string, content io.Reader, context VectorClock, consistency Consistency) (int, error) {
+	return StoreFileWithContext(fileName, node, content, context, consistency)
+}
+
+// Get downloads the file from the Chord and writes its content to w, with the ReadConsistency of the options
+// ErrConcurrentVersions is returned if the file has versions written concurrently, see GetSiblings
+func (node *Node) Get(fileName string, w io.Writer) error {
+	return FetchFile(fileName, node, w)
+}
+
+// GetWithConsistency downloads the file like Get, and returns how many copies answered the read
+func (node *Node) GetWithConsistency(fileName string, w io.Writer, consistency Consistency) (int, error) {
+	return FetchFileWithConsistency(fileName, node, w, consistency)
+}
+
+// GetSiblings downloads every version of the file that was written concurrently, and returns them
+// with their content and how many copies answered the read, the caller resolves the conflict by writing a merged version
+func (node *Node) GetSiblings(fileName string, consistency Consistency) ([]Sibling, int, error) {
+	return FetchSiblings(fileName, node, consistency)
+}
+
+// Delete removes the file from the Chord
+func (node *Node) Delete(fileName string) error {
+	return DeleteFile(fileName, node)
+}
+
+// TaskStats returns the run statistics of the maintenance tasks by name, empty if the node is not started
+func (node *Node) TaskStats() map[string]TaskStats {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	stats := make(map[string]TaskStats, len(node.executors))
+	for _, executor := range node.executors {
+		stats[executor.Name] = executor.Stats()
+	}
+	return stats
+}
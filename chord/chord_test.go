@@ -0,0 +1,357 @@
+package chord
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// crash stops the node without leaving the Chord, as if its process was killed
+func crash(node *Node) {
+	node.mutex.Lock()
+	executors := node.executors
+	node.executors = nil
+	node.mutex.Unlock()
+	for _, executor := range executors {
+		executor.Stop()
+	}
+	node.listener.Close()
+	node.listener = nil
+}
+
+// ringFormed tells whether following the successors from the first node goes through all the nodes and back
+func ringFormed(nodes []*Node) bool {
+	byAddr := make(map[string]*Node)
+	for _, node := range nodes {
+		byAddr[node.Addr] = node
+	}
+	addr := nodes[0].Addr
+	seen := make(map[string]bool)
+	for range nodes {
+		node, ok := byAddr[addr]
+		if !ok || seen[addr] {
+			return false
+		}
+		seen[addr] = true
+		addr = successorOf(node)
+	}
+	return addr == nodes[0].Addr
+}
+
+// TestChurn stores and fetches files from several nodes while other nodes join, leave and crash,
+// it is meant to be run with -race
+func TestChurn(t *testing.T) {
+	network := NewMemoryTransport(2 * time.Second)
+	root := t.TempDir()
+	options := func(port int) Options {
+		options := testOptions(t, network, root, port)
+		options.M = 16
+		options.Replicas = 2
+		options.WriteConsistency = ConsistencyQuorum
+		return options
+	}
+
+	var nodes []*Node
+	for i := 0; i < 6; i++ {
+		var seeds []string
+		if i > 0 {
+			seeds = append(seeds, nodes[0].Addr)
+		}
+		nodes = append(nodes, startNode(t, options(9300+i), seeds...))
+	}
+	waitFor(t, 10*time.Second, "the ring of six nodes", func() bool { return ringFormed(nodes) })
+
+	// the clients write through the first three nodes, the others churn
+	clients := nodes[:3]
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	stored := make(map[string]string)
+	stop := make(chan struct{})
+	for c, client := range clients {
+		wg.Add(1)
+		go func(c int, client *Node) {
+			defer wg.Done()
+			for r := 0; ; r++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				name := fmt.Sprintf("c%d-%d.txt", c, r)
+				content := "content of " + name
+				// a write may fail while the ring is changing, only the acknowledged ones must survive
+				if client.Put(name, strings.NewReader(content)) == nil {
+					mutex.Lock()
+					stored[name] = content
+					mutex.Unlock()
+				}
+				client.Get(name, io.Discard)
+				client.Lookup(name)
+				time.Sleep(10 * time.Millisecond)
+			}
+		}(c, client)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	joined := startNode(t, options(9306), nodes[0].Addr)
+	time.Sleep(300 * time.Millisecond)
+	if err := nodes[3].Stop(); err != nil {
+		t.Log("leave:", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	crash(nodes[4])
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	live := []*Node{nodes[0], nodes[1], nodes[2], nodes[5], joined}
+	defer func() {
+		for _, node := range live {
+			node.Stop()
+		}
+	}()
+	waitFor(t, 10*time.Second, "the ring after the churn", func() bool { return ringFormed(live) })
+	if len(stored) == 0 {
+		t.Fatal("no write was acknowledged")
+	}
+
+	// a quorum write is stored by two nodes, so it survives one crash
+	reader := nodes[0]
+	for name, content := range stored {
+		var got bytes.Buffer
+		waitFor(t, 5*time.Second, "the file "+name, func() bool {
+			got.Reset()
+			return reader.Get(name, &got) == nil
+		})
+		if got.String() != content {
+			t.Errorf("%s holds %q instead of %q", name, got, content)
+		}
+	}
+}
+
+// startRing starts n nodes on an in-memory network, with two backups of every file unless configure changes the options,
+// and waits for the ring
+func startRing(t *testing.T, n int, port int, configure func(*Options)) []*Node {
+	network := NewMemoryTransport(2 * time.Second)
+	root := t.TempDir()
+	var nodes []*Node
+	for i := 0; i < n; i++ {
+		options := testOptions(t, network, root, port+i)
+		options.M = 16
+		options.Replicas = 2
+		if configure != nil {
+			configure(&options)
+		}
+		var seeds []string
+		if i > 0 {
+			seeds = append(seeds, nodes[0].Addr)
+		}
+		nodes = append(nodes, startNode(t, options, seeds...))
+	}
+	waitFor(t, 10*time.Second, "the ring", func() bool { return ringFormed(nodes) })
+	return nodes
+}
+
+// holds tells whether the node holds the id, or a tombstone of it
+func holds(node *Node, id *big.Int) (file bool, tombstone bool) {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	file = containsKey(node.Bucket, id) || containsKey(node.Backup, id)
+	tombstone = containsKey(node.Tombstone, id) || containsKey(node.BackupTombstone, id)
+	return file, tombstone
+}
+
+func TestDeleteWhileOwnerIsDown(t *testing.T) {
+	nodes := startRing(t, 4, 9320, nil)
+	owner, err := nodes[0].Lookup("f.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the writer is any node but the owner, which crashes after the write
+	var writer *Node
+	var live []*Node
+	for _, node := range nodes {
+		if node.Addr == owner {
+			continue
+		}
+		if writer == nil {
+			writer = node
+		}
+		live = append(live, node)
+	}
+	defer func() {
+		for _, node := range live {
+			node.Stop()
+		}
+	}()
+	if _, err := writer.PutWithConsistency("f.txt", strings.NewReader("f"), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range nodes {
+		if node.Addr == owner {
+			crash(node)
+		}
+	}
+	if err := writer.Delete("f.txt"); err != nil {
+		t.Fatal("the delete failed while the owner is down: ", err)
+	}
+
+	waitFor(t, 10*time.Second, "the ring without the owner", func() bool { return ringFormed(live) })
+	id := new(big.Int).Mod(StrHash("f.txt"), writer.HashMod)
+	waitFor(t, 5*time.Second, "the copies to be dropped", func() bool {
+		for _, node := range live {
+			if file, _ := holds(node, id); file {
+				return false
+			}
+		}
+		return true
+	})
+	if err := writer.Get("f.txt", io.Discard); err == nil {
+		t.Error("the deleted file is still found")
+	}
+}
+
+func TestTombstoneCompaction(t *testing.T) {
+	nodes := startRing(t, 3, 9330, func(options *Options) {
+		options.TombstoneTTL = 300 * time.Millisecond
+	})
+	defer func() {
+		for _, node := range nodes {
+			node.Stop()
+		}
+	}()
+	writer := nodes[0]
+	if _, err := writer.PutWithConsistency("f.txt", strings.NewReader("f"), ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Delete("f.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the owner drops the tombstone once both replicas have it, then the replicas drop theirs
+	id := new(big.Int).Mod(StrHash("f.txt"), writer.HashMod)
+	waitFor(t, 10*time.Second, "the tombstones to be compacted", func() bool {
+		for _, node := range nodes {
+			if _, tombstone := holds(node, id); tombstone {
+				return false
+			}
+		}
+		return true
+	})
+	for _, node := range nodes {
+		if file, _ := holds(node, id); file {
+			t.Errorf("node %s holds the deleted file again", node.Addr)
+		}
+	}
+	if err := writer.Get("f.txt", io.Discard); err == nil {
+		t.Error("the deleted file is found after its tombstone is compacted")
+	}
+}
+
+func TestPutAndGetContent(t *testing.T) {
+	nodes := startRing(t, 2, 9340, func(options *Options) {
+		options.Replicas = 1
+	})
+	defer func() {
+		for _, node := range nodes {
+			node.Stop()
+		}
+	}()
+	if err := nodes[0].Put("f.txt", strings.NewReader("first")); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := nodes[1].Get("f.txt", &got); err != nil || got.String() != "first" {
+		t.Fatalf("the read returns %q, %v", got.String(), err)
+	}
+
+	// two writes which have not seen each other are kept as siblings
+	if _, err := nodes[1].PutWithContext("g.txt", strings.NewReader("a"), VectorClock{}, ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[0].PutWithContext("g.txt", strings.NewReader("b"), VectorClock{}, ConsistencyAll); err != nil {
+		t.Fatal(err)
+	}
+	got.Reset()
+	if err := nodes[0].Get("g.txt", &got); !errors.Is(err, ErrConcurrentVersions) || got.Len() != 0 {
+		t.Fatalf("the read of concurrent versions returns %q, %v", got.String(), err)
+	}
+	siblings, _, err := nodes[0].GetSiblings("g.txt", ConsistencyAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, sibling := range siblings {
+		contents = append(contents, string(sibling.Content))
+	}
+	sort.Strings(contents)
+	if strings.Join(contents, ",") != "a,b" {
+		t.Errorf("the siblings hold %v", contents)
+	}
+}
+
+func TestHandBackIsQueuedOnce(t *testing.T) {
+	network := NewMemoryTransport(2 * time.Second)
+	root := t.TempDir()
+	newTestNode := func(port int) *Node {
+		options := testOptions(t, network, root, port)
+		options.M = 16
+		node, err := NewNode(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	owner := newTestNode(9350)
+	replica := newTestNode(9351)
+	for _, node := range []*Node{owner, replica} {
+		listener, err := ServeNode(network, node, node.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+	}
+
+	// the write reached the backup of the replica only
+	id := new(big.Int).Mod(StrHash("f.txt"), replica.HashMod)
+	clock := VectorClock{"writer": 1}
+	if err := os.WriteFile(replica.siblingPath("f.txt", clock), []byte("f"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	replica.mutex.Lock()
+	replica.Backup[id] = "f.txt"
+	replica.Siblings["f.txt"] = []VectorClock{clock}
+	replica.mutex.Unlock()
+
+	// every sync of the owner finds the version it lacks, the version is handed back once
+	start := new(big.Int).Sub(id, big.NewInt(1))
+	args := SyncBackupRPCArgs{Owner: owner.Addr, Start: start, End: id, Tombstone: make(map[*big.Int]string)}
+	for i := 0; i < 3; i++ {
+		if err := replica.SyncBackupRPC(args, &SyncBackupRPCReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(replica.handBacks) != 1 {
+		t.Fatalf("%d hand-backs are queued", len(replica.handBacks))
+	}
+	if err := replica.handBack(); err != nil {
+		t.Fatal(err)
+	}
+	if len(replica.handBacks) != 0 {
+		t.Error("the hand-back is still queued")
+	}
+	owner.mutex.RLock()
+	defer owner.mutex.RUnlock()
+	if !containsKey(owner.Bucket, id) || !hasClock(owner.Siblings["f.txt"], clock) {
+		t.Error("the version is not handed back to the bucket of the owner")
+	}
+}
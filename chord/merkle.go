@@ -0,0 +1,275 @@
+package chord
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+)
+
+// the owner of a range and its replicas compare Merkle trees of the range to find where their copies differ
+// the tree of a range (Start, End] splits it into 2^merkleDepth leaves of equal width, the nodes are numbered
+// like a heap: the root is 1 and the children of i are 2i and 2i+1, so both sides build the same shape
+const merkleDepth = 8
+
+// merkleEntry is a version of a file or a tombstone of a range, the hash of a leaf covers the entries of its interval
+type merkleEntry struct {
+	Id      *big.Int
+	Name    string
+	Clock   VectorClock
+	Deleted bool
+
+	version string // the clock as a string, see VectorClock.String
+}
+
+// merkleTree holds the hashes of the nodes of the tree of a range, the index 0 is not used
+type merkleTree struct {
+	Start  *big.Int
+	End    *big.Int
+	Hashes [][]byte
+}
+
+// newMerkleTree builds the tree of the entries of the range (Start, End], the entries out of the range are ignored
+// the width of the range is End-Start modulo 2^M, the whole ring if Start equals End
+func newMerkleTree(start, end, hashMod *big.Int, entries []merkleEntry) *merkleTree {
+	leaves := 1 << merkleDepth
+	width := rangeWidth(start, end, hashMod)
+	buckets := make([][]merkleEntry, leaves)
+	for _, e := range entries {
+		if !between(start, e.Id, end, true) {
+			continue
+		}
+		leaf := merkleLeaf(start, e.Id, width, hashMod)
+		buckets[leaf] = append(buckets[leaf], e)
+	}
+
+	tree := &merkleTree{Start: start, End: end, Hashes: make([][]byte, 2*leaves)}
+	for i, bucket := range buckets {
+		for j := range bucket {
+			bucket[j].version = bucket[j].Clock.String()
+		}
+		sort.Slice(bucket, func(a, b int) bool {
+			if c := bucket[a].Id.Cmp(bucket[b].Id); c != 0 {
+				return c < 0
+			}
+			return bucket[a].version < bucket[b].version
+		})
+		h := sha1.New()
+		for _, e := range bucket {
+			h.Write([]byte(e.Id.String() + " " + e.Name + " " + e.version + " " + strconv.FormatBool(e.Deleted) + "\n"))
+		}
+		tree.Hashes[leaves+i] = h.Sum(nil)
+	}
+	for i := leaves - 1; i >= 1; i-- {
+		h := sha1.New()
+		h.Write(tree.Hashes[2*i])
+		h.Write(tree.Hashes[2*i+1])
+		tree.Hashes[i] = h.Sum(nil)
+	}
+	return tree
+}
+
+// rangeWidth returns the number of identifiers in (start, end]
+func rangeWidth(start, end, hashMod *big.Int) *big.Int {
+	width := new(big.Int).Sub(end, start)
+	width.Mod(width, hashMod)
+	if width.Sign() == 0 {
+		width.Set(hashMod)
+	}
+	return width
+}
+
+// merkleLeaf returns the leaf of the id, the leaf j covers the offsets [width*j/2^depth, width*(j+1)/2^depth)
+// where the offset of an id is id-start-1
+func merkleLeaf(start, id, width, hashMod *big.Int) int {
+	offset := new(big.Int).Sub(id, start)
+	offset.Sub(offset, big.NewInt(1))
+	offset.Mod(offset, hashMod)
+	offset.Lsh(offset, merkleDepth)
+	offset.Div(offset, width)
+	return int(offset.Int64())
+}
+
+// leafRange returns the range (Start, End] of the ids of the leaf, as in merkleLeaf
+func (tree *merkleTree) leafRange(leaf int, hashMod *big.Int) (*big.Int, *big.Int) {
+	width := rangeWidth(tree.Start, tree.End, hashMod)
+	bound := func(j int) *big.Int {
+		// the smallest offset of the leaf j is ceil(width*j/2^depth)
+		b := new(big.Int).Mul(width, big.NewInt(int64(j)))
+		b.Add(b, big.NewInt(1<<merkleDepth-1))
+		b.Rsh(b, merkleDepth)
+		b.Add(b, tree.Start)
+		return b.Mod(b, hashMod)
+	}
+	return bound(leaf), bound(leaf + 1)
+}
+
+// bucketEntries returns the files and the tombstones of the bucket, the caller holds the lock
+func (node *Node) bucketEntries() []merkleEntry {
+	entries := make([]merkleEntry, 0, len(node.Bucket)+len(node.Tombstone))
+	for k, v := range node.Bucket {
+		for _, clock := range node.Siblings[v] {
+			entries = append(entries, merkleEntry{Id: k, Name: v, Clock: clock})
+		}
+	}
+	for k, v := range node.Tombstone {
+		entries = append(entries, merkleEntry{Id: k, Name: v, Deleted: true})
+	}
+	return entries
+}
+
+// backupEntries returns the files and the tombstones of the backup, the caller holds the lock
+func (node *Node) backupEntries() []merkleEntry {
+	entries := make([]merkleEntry, 0, len(node.Backup)+len(node.BackupTombstone))
+	for k, v := range node.Backup {
+		if node.isBackupTombstone(k) {
+			continue
+		}
+		for _, clock := range node.Siblings[v] {
+			entries = append(entries, merkleEntry{Id: k, Name: v, Clock: clock})
+		}
+	}
+	for k, v := range node.BackupTombstone {
+		entries = append(entries, merkleEntry{Id: k, Name: v, Deleted: true})
+	}
+	return entries
+}
+
+type MerkleTreeRPCArgs struct {
+	Start *big.Int // the range (Start, End] of the owner
+	End   *big.Int
+	Nodes []int // the nodes of the tree whose hashes are asked for
+}
+
+type MerkleTreeRPCReply struct {
+	Hashes [][]byte // the hashes of the nodes, in the order they were asked for
+}
+
+// MerkleTreeRPC returns hashes of the tree of the backup of a range, the owner of the range walks down
+// the tree level by level and asks only for the children of the nodes that differ from its own tree
+func (node *Node) MerkleTreeRPC(args MerkleTreeRPCArgs, reply *MerkleTreeRPCReply) error {
+	if args.Start == nil || args.End == nil {
+		return errors.New("the range of the Merkle tree is not given")
+	}
+	node.mutex.RLock()
+	entries := node.backupEntries()
+	hashMod := node.HashMod
+	node.mutex.RUnlock()
+	tree := newMerkleTree(args.Start, args.End, hashMod, entries)
+	for _, i := range args.Nodes {
+		if i < 1 || i >= len(tree.Hashes) {
+			reply.Hashes = append(reply.Hashes, nil)
+			continue
+		}
+		reply.Hashes = append(reply.Hashes, tree.Hashes[i])
+	}
+	return nil
+}
+
+// antiEntropy compares the bucket of the range (predecessor, node] with the backup of every replica,
+// and repairs the leaves of the tree which differ, so that a lost transfer or deletion is made up for
+// the replicas are the successors which replicate has synced, a new replica is synced as a whole by replicate
+// the tombstones which every replica holds are then compacted, see compactTombstones
+func (node *Node) antiEntropy() error {
+	node.mutex.RLock()
+	predecessorId := node.PredecessorId
+	replicas := append([]string{}, node.replicas...)
+	entries := node.bucketEntries()
+	hashMod := node.HashMod
+	node.mutex.RUnlock()
+	if predecessorId == nil || predecessorId.Cmp(node.Identifier) == 0 {
+		node.compactTombstones()
+		return nil
+	}
+
+	tree := newMerkleTree(predecessorId, node.Identifier, hashMod, entries)
+	var tombstones []string
+	for _, e := range entries {
+		if e.Deleted && between(predecessorId, e.Id, node.Identifier, true) {
+			tombstones = append(tombstones, e.Name)
+		}
+	}
+	var firstErr error
+	for _, replica := range replicas {
+		leaves, err := node.divergentLeaves(replica, tree)
+		if err == nil && len(leaves) == 0 {
+			// the backup of the replica holds the same tombstones
+			node.ackTombstones(replica, tombstones)
+		}
+		if err == nil {
+			for _, leaf := range leaves {
+				start, end := tree.leafRange(leaf, hashMod)
+				if start.Cmp(end) == 0 {
+					// the leaf is narrower than one identifier and holds nothing
+					continue
+				}
+				err = node.repairRange(replica, start, end)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("[antiEntropy] Failed to repair the backup at %s: %s\n", replica, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	node.compactTombstones()
+	return firstErr
+}
+
+// divergentLeaves walks down the trees of the node and of the replica, and returns the leaves that differ
+func (node *Node) divergentLeaves(replica string, tree *merkleTree) ([]int, error) {
+	leaves := 1 << merkleDepth
+	nodes := []int{1}
+	for len(nodes) > 0 {
+		var merkleTreeRPCReply MerkleTreeRPCReply
+		args := MerkleTreeRPCArgs{Start: tree.Start, End: tree.End, Nodes: nodes}
+		err := node.call(replica, "Node.MerkleTreeRPC", args, &merkleTreeRPCReply)
+		if err != nil {
+			return nil, err
+		}
+		var differ []int
+		for j, i := range nodes {
+			if j >= len(merkleTreeRPCReply.Hashes) || !bytes.Equal(merkleTreeRPCReply.Hashes[j], tree.Hashes[i]) {
+				differ = append(differ, i)
+			}
+		}
+		if nodes[0] >= leaves {
+			// the nodes of the last level are the leaves
+			for j := range differ {
+				differ[j] -= leaves
+			}
+			return differ, nil
+		}
+		nodes = nil
+		for _, i := range differ {
+			nodes = append(nodes, 2*i, 2*i+1)
+		}
+	}
+	return nil, nil
+}
+
+// repairRange syncs the backup of the range (start, end] at the replica with the bucket, like replicate does
+func (node *Node) repairRange(replica string, start, end *big.Int) error {
+	node.mutex.RLock()
+	args := SyncBackupRPCArgs{Owner: node.Addr, Start: start, End: end, Tombstone: make(map[*big.Int]string)}
+	for k, v := range node.Bucket {
+		if between(start, k, end, true) {
+			args.Files = append(args.Files, node.fileDigests(k, v)...)
+		}
+	}
+	for k, v := range node.Tombstone {
+		if between(start, k, end, true) {
+			args.Tombstone[k] = v
+		}
+	}
+	node.mutex.RUnlock()
+	log.Printf("[repairRange] Repair the backup of (%s, %s] at %s\n", start, end, replica)
+	return node.syncReplica(replica, args)
+}
@@ -0,0 +1,145 @@
+package chord
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var testHashMod = big.NewInt(1 << 16)
+
+func testEntries() []merkleEntry {
+	return []merkleEntry{
+		{Id: big.NewInt(65100), Name: "a.txt", Clock: VectorClock{"n1": 1}},
+		{Id: big.NewInt(65535), Name: "b.txt", Clock: VectorClock{"n1": 2, "n2": 1}},
+		{Id: big.NewInt(0), Name: "c.txt", Deleted: true},
+		{Id: big.NewInt(700), Name: "d.txt", Clock: VectorClock{"n2": 3}},
+		{Id: big.NewInt(700), Name: "d.txt", Clock: VectorClock{"n1": 1}},
+	}
+}
+
+func TestMerkleTreeOfTheSameEntries(t *testing.T) {
+	start, end := big.NewInt(65000), big.NewInt(1000)
+	entries := testEntries()
+	reversed := make([]merkleEntry, 0, len(entries)+1)
+	for i := len(entries) - 1; i >= 0; i-- {
+		reversed = append(reversed, entries[i])
+	}
+	// an entry out of the range does not count
+	reversed = append(reversed, merkleEntry{Id: big.NewInt(5000), Name: "e.txt", Clock: VectorClock{"n1": 1}})
+
+	a := newMerkleTree(start, end, testHashMod, entries)
+	b := newMerkleTree(start, end, testHashMod, reversed)
+	for i := 1; i < len(a.Hashes); i++ {
+		if !bytes.Equal(a.Hashes[i], b.Hashes[i]) {
+			t.Fatalf("the trees of the same entries differ at node %d", i)
+		}
+	}
+
+	changed := testEntries()
+	changed[1].Clock = VectorClock{"n1": 3, "n2": 1}
+	c := newMerkleTree(start, end, testHashMod, changed)
+	if bytes.Equal(a.Hashes[1], c.Hashes[1]) {
+		t.Error("the trees of different entries have the same root")
+	}
+}
+
+func TestDivergentLeaves(t *testing.T) {
+	network := NewMemoryTransport(2 * time.Second)
+	root := t.TempDir()
+	newTestNode := func(port int) *Node {
+		options := testOptions(t, network, root, port)
+		options.M = 16
+		node, err := NewNode(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	owner := newTestNode(9500)
+	replica := newTestNode(9501)
+	listener, err := ServeNode(network, replica, replica.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// the backup of the replica holds the entries of the owner
+	entries := testEntries()
+	replica.mutex.Lock()
+	for _, e := range entries {
+		if e.Deleted {
+			replica.BackupTombstone[e.Id] = e.Name
+			continue
+		}
+		// the siblings of a file are kept under a single key
+		if _, ok := replica.Siblings[e.Name]; !ok {
+			replica.Backup[e.Id] = e.Name
+		}
+		replica.Siblings[e.Name] = append(replica.Siblings[e.Name], e.Clock)
+	}
+	replica.mutex.Unlock()
+
+	start, end := big.NewInt(65000), big.NewInt(1000)
+	tree := newMerkleTree(start, end, testHashMod, entries)
+	leaves, err := owner.divergentLeaves(replica.Addr, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != 0 {
+		t.Fatalf("the same entries differ at the leaves %v", leaves)
+	}
+
+	// the replica missed the last write of b.txt
+	entries[1].Clock = VectorClock{"n1": 3, "n2": 1}
+	tree = newMerkleTree(start, end, testHashMod, entries)
+	leaves, err = owner.divergentLeaves(replica.Addr, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := merkleLeaf(start, entries[1].Id, rangeWidth(start, end, testHashMod), testHashMod)
+	if len(leaves) != 1 || leaves[0] != want {
+		t.Fatalf("the changed entry is found at the leaves %v instead of %d", leaves, want)
+	}
+	leafStart, leafEnd := tree.leafRange(want, testHashMod)
+	if !between(leafStart, entries[1].Id, leafEnd, true) {
+		t.Errorf("the range (%s, %s] of the leaf does not hold the changed entry", leafStart, leafEnd)
+	}
+}
+
+func TestLeafRangeAtTheWrapAround(t *testing.T) {
+	// the range (65000, 1000] goes through 0
+	start, end := big.NewInt(65000), big.NewInt(1000)
+	tree := newMerkleTree(start, end, testHashMod, nil)
+	width := rangeWidth(start, end, testHashMod)
+	if width.Int64() != 1536 {
+		t.Fatalf("the width of the range is %s", width)
+	}
+
+	// the leaves cover the range one after the other
+	leaves := 1 << merkleDepth
+	first, _ := tree.leafRange(0, testHashMod)
+	_, last := tree.leafRange(leaves-1, testHashMod)
+	if first.Cmp(start) != 0 || last.Cmp(end) != 0 {
+		t.Fatalf("the leaves cover (%s, %s]", first, last)
+	}
+	for leaf := 0; leaf < leaves-1; leaf++ {
+		_, a := tree.leafRange(leaf, testHashMod)
+		b, _ := tree.leafRange(leaf+1, testHashMod)
+		if a.Cmp(b) != 0 {
+			t.Fatalf("the leaf %d ends at %s, the next one starts at %s", leaf, a, b)
+		}
+	}
+
+	// every id of the range is in the range of its leaf
+	for offset := int64(1); offset <= width.Int64(); offset++ {
+		id := new(big.Int).Add(start, big.NewInt(offset))
+		id.Mod(id, testHashMod)
+		leaf := merkleLeaf(start, id, width, testHashMod)
+		leafStart, leafEnd := tree.leafRange(leaf, testHashMod)
+		if leaf < 0 || leaf >= leaves || !between(leafStart, id, leafEnd, true) {
+			t.Fatalf("the id %s is put in the leaf %d of (%s, %s]", id, leaf, leafStart, leafEnd)
+		}
+	}
+}
@@ -0,0 +1,559 @@
+package chord
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+//initial keyID and nodeID are m-length hash value
+//then the m-length hash value mod 2^m ---> [0,2^m-1], ranged on the chord
+
+// the identifier bit-width m is chosen per ring when it is created, 6 by default
+// it can not exceed the 160 bits of the SHA-1 digest returned by StrHash
+const MaxIdentifierBits = 160
+
+// ParseIdentifier reads a node identifier given as the 40 hex digits of a SHA-1 sum
+func ParseIdentifier(hex string) (*big.Int, error) {
+	if !identifierPattern.MatchString(hex) {
+		return nil, fmt.Errorf("identifier %q is not %d hex digits", hex, MaxIdentifierBits/4)
+	}
+	id, _ := new(big.Int).SetString(hex, 16)
+	return id, nil
+}
+
+var identifierPattern = regexp.MustCompile("^[0-9a-fA-F]{40}$")
+
+// each node will hold a finger table with m-length
+// the i-th item of the finger table is nodeN+2^(i-1)
+
+type fingerItem struct {
+	Identifier []byte //hash id, which is m-length
+	//Identifier should be mapped into [0,(2^m-1)], on the chord with 2^m nodes in total
+
+	Addr   string   //address of node
+	NodeId *big.Int //identifier of the node at Addr, learned with the address so that no RPC is needed to compare it
+}
+
+type Node struct {
+	Name       string   // can be address or user-defined name which is given by the input args
+	Addr       string   // IP:Port
+	Identifier *big.Int //chord space identifier,[0,2^M-1]
+
+	M       int      //identifier bit-width of the ring
+	HashMod *big.Int //2^M, the size of the chord space
+
+	FingerTable []fingerItem
+	nextFinger  int //the index of the next finger, [0,m-1]
+
+	PredecessorAddr string
+	PredecessorId   *big.Int //identifier of the predecessor, nil if there is none
+	//the size of successor list is given by the input argument
+	SuccessorsAddr []string
+	SuccessorsId   []*big.Int //identifiers of the successors, nil for an empty entry
+
+	//guards the ring pointers, the finger table, the files and the transfers
+	//it is never held during an RPC, the state is copied out and the RPC result is applied afterwards
+	mutex     sync.RWMutex
+	saveMutex sync.Mutex //serializes the writes of the state file, see saveState
+
+	//counts the changes of the predecessor, the successors and the fingers, see membershipChanged
+	ringChanges uint64
+	//addresses of the nodes that did not answer, see suspect
+	suspected map[string]bool
+
+	//file encryption
+	PrivateKey  *rsa.PrivateKey
+	PublicKey   *rsa.PublicKey
+	EncryptFlag bool
+
+	//For fault tolerance
+	Bucket map[*big.Int]string
+	Backup map[*big.Int]string //copies of the buckets of the predecessors, up to Replicas of them
+
+	//the versions of every file of the Bucket and the Backup by name, more than one if they were written concurrently
+	Siblings map[string][]VectorClock
+	//the versions of the files that the node has read or written, its next write of a file descends them
+	contexts map[string]VectorClock
+	//the writes of the node, its entry in the clocks of the versions it writes
+	writes uint64
+
+	//the successors holding a backup of the bucket, see replicate
+	replicas []string
+
+	//deleted files, so that the replication does not resurrect them
+	Tombstone       map[*big.Int]string //files deleted from the Bucket
+	BackupTombstone map[*big.Int]string //files deleted by the predecessor, mirrored from its Tombstone
+	//the replicas which have recorded the tombstones of the Bucket, by file name, see compactTombstones
+	tombstoneAcks map[string]*tombstoneAck
+
+	//files being received in chunks, by transfer id
+	transfers map[string]*transfer
+	//versions of the backup to be sent back to their owner, by sibling file, see handBack
+	handBacks map[string]*handBackItem
+
+	//lifecycle, see Start and Stop
+	options      Options
+	listener     io.Closer
+	executors    []*ScheduledExecutor
+	transport    Transport //carries the RPCs of the node, see call
+	ownTransport bool      //the transport was created by NewNode, it is closed by Stop
+}
+
+// the first node in the chord, no predecessor, all the successors are the node itself
+// the identifier bit-width of the node becomes the bit-width of the whole ring
+func (node *Node) createNewChord() {
+	log.Printf("Node %s creates a new Chord with %d-bit identifiers", node.Addr, node.M)
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.PredecessorAddr = ""
+	node.PredecessorId = nil
+	for i := 0; i < len(node.SuccessorsAddr); i++ {
+		node.SuccessorsAddr[i] = node.Addr
+		node.SuccessorsId[i] = node.Identifier
+	}
+}
+
+// NewNode create a new node, and assign the initial values to it's attributes
+// the node does not take part in any Chord until Start is called
+// an error is returned if the options can not make a node, e.g. M is wider than MaxIdentifierBits
+func NewNode(options Options) (*Node, error) {
+	options.setDefaults()
+	if options.M > MaxIdentifierBits {
+		return nil, fmt.Errorf("the identifier bit-width %d is wider than the %d bits of the SHA-1 digest", options.M, MaxIdentifierBits)
+	}
+
+	//assign address to the new node
+	newNode := &Node{}
+	newNode.options = options
+	newNode.Addr = options.advertiseAddr()
+	newNode.transport = options.Transport
+	if newNode.transport == nil {
+		newNode.transport = NewTCPTransport(DefaultDialTimeout, DefaultCallTimeout)
+		newNode.ownTransport = true
+	}
+
+	//assign name to the new node
+	if options.ClientName == "" || options.ClientName == "default" {
+		newNode.Name = newNode.Addr
+	} else {
+		newNode.Name = options.ClientName
+	}
+
+	newNode.M = options.M
+	newNode.HashMod = new(big.Int).Exp(big.NewInt(2), big.NewInt(int64(newNode.M)), nil)
+
+	//[0,2^M-1]
+	if options.Identifier != nil {
+		newNode.Identifier = new(big.Int).Mod(options.Identifier, newNode.HashMod)
+	} else {
+		newNode.Identifier = StrHash(newNode.Addr)
+		newNode.Identifier.Mod(newNode.Identifier, newNode.HashMod)
+	}
+
+	newNode.FingerTable = make([]fingerItem, newNode.M+1)
+
+	newNode.nextFinger = 0
+
+	newNode.PredecessorAddr = ""
+	newNode.SuccessorsAddr = make([]string, options.R)
+	newNode.SuccessorsId = make([]*big.Int, options.R)
+
+	//initiate id to n+2^(i-1), all addr to node.Addr
+	newNode.initFingerTable()
+	//initiate all to empty string
+	newNode.initSuccessorsAddr()
+
+	newNode.EncryptFlag = true
+
+	newNode.Bucket = make(map[*big.Int]string)
+	newNode.Backup = make(map[*big.Int]string)
+	newNode.Siblings = make(map[string][]VectorClock)
+	newNode.contexts = make(map[string]VectorClock)
+	newNode.Tombstone = make(map[*big.Int]string)
+	newNode.BackupTombstone = make(map[*big.Int]string)
+	newNode.tombstoneAcks = make(map[string]*tombstoneAck)
+	newNode.transfers = make(map[string]*transfer)
+	newNode.handBacks = make(map[string]*handBackItem)
+	newNode.suspected = make(map[string]bool)
+
+	rootPath := newNode.nodeFolder()
+	//if the file did not exist
+	if _, err := os.Stat(rootPath); os.IsNotExist(err) {
+		err := os.MkdirAll(rootPath, os.ModePerm)
+		if err != nil {
+			log.Println("failed to create folder: " + rootPath + err.Error())
+		} else {
+
+			fileMode := []string{"/chord_storage"}
+			for _, mode := range fileMode {
+				//create the chord folder for a certain node
+				if _, err := os.Stat(rootPath + mode); os.IsNotExist(err) {
+					err := os.Mkdir(rootPath+mode, os.ModePerm)
+					if err != nil {
+						log.Println("failed to create file of: " + rootPath + mode + err.Error())
+					}
+				} else {
+					log.Println("the file of :" + rootPath + mode + " already exist")
+				}
+			}
+
+		}
+		newNode.genRSAKey(2048)
+	} else {
+		fmt.Println("the node folder of" + rootPath + " already exist, restore the node state")
+		//the node is restarted, reuse its keys and the files it held
+		err := newNode.loadRSAKey()
+		if err != nil {
+			log.Println("failed to load the RSA key, generate a new one: " + err.Error())
+			newNode.genRSAKey(2048)
+		}
+		newNode.loadState()
+	}
+	return newNode, nil
+}
+
+// m rows
+// each row contains key-id, successor(key-id),interval[]
+func (node *Node) initFingerTable() {
+	node.FingerTable[0].Identifier = node.Identifier.Bytes()
+	node.FingerTable[0].Addr = node.Addr
+	node.FingerTable[0].NodeId = node.Identifier
+	fmt.Println("fingerTable[0] of node-", node.Name, " is:", node.FingerTable[0].Identifier, node.FingerTable[0].Addr)
+	//add rows in finger table
+	for i := 1; i < node.M+1; i++ {
+		node.FingerTable[i].Identifier = node.FingerStart(i).Bytes()
+		node.FingerTable[i].Addr = node.Addr
+		node.FingerTable[i].NodeId = node.Identifier
+	}
+}
+
+func (node *Node) initSuccessorsAddr() {
+	successorsAddrNum := len(node.SuccessorsAddr)
+	for i := 0; i < successorsAddrNum; i++ {
+		node.SuccessorsAddr[i] = ""
+		node.SuccessorsId[i] = nil
+	}
+}
+
+func (node *Node) joinChord(joinNodeAddr string) error {
+	log.Printf("Node %s wanna join the Chord: %s", node.Addr, joinNodeAddr)
+	node.mutex.Lock()
+	node.PredecessorAddr = ""
+	node.PredecessorId = nil
+	node.mutex.Unlock()
+
+	//refuse to join a ring whose identifier space differs from ours
+	var getIdentifierBitsRPCReply GetIdentifierBitsRPCReply
+	err := node.call(joinNodeAddr, "Node.GetIdentifierBitsRPC", "", &getIdentifierBitsRPCReply)
+	if err != nil {
+		return err
+	}
+	if getIdentifierBitsRPCReply.M != node.M {
+		return fmt.Errorf("%w: identifier bit-width mismatch: the Chord uses m=%d, node %s uses m=%d",
+			ErrJoinRefused, getIdentifierBitsRPCReply.M, node.Addr, node.M)
+	}
+
+	//find the successor of node and store it in index-0
+	var reply FindSuccessorRPCReply
+	err = node.call(joinNodeAddr, "Node.FindSuccessorRPC", node.Identifier, &reply)
+	if err != nil {
+		return err
+	}
+	//the successor of our identifier holds it already if another node uses the same identifier
+	if reply.SuccessorId != nil && reply.SuccessorId.Cmp(node.Identifier) == 0 && reply.SuccessorAddress != node.Addr {
+		return fmt.Errorf("%w: identifier %s is already used by node %s", ErrJoinRefused, node.Identifier, reply.SuccessorAddress)
+	}
+	node.mutex.Lock()
+	node.SuccessorsAddr[0] = reply.SuccessorAddress
+	node.SuccessorsId[0] = reply.SuccessorId
+	node.mutex.Unlock()
+
+	//node is the predecessor of node.Successor
+	//communicate with node.Successor and notify it to modify the predecessor of node.SuccessorAddr[0] to node.Addr
+	err = node.call(reply.SuccessorAddress, "Node.NotifyRPC", NotifyRPCArgs{Addr: node.Addr, Identifier: node.Identifier}, &NotifyRPCReply{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// joinSeeds joins the Chord through the first seed that answers, and checks that the successor took the node in
+// every seed is tried in a round, the rounds are separated by a backoff which doubles after every round
+func (node *Node) joinSeeds(seeds []string, attempts int) error {
+	backoff := node.options.JoinBackoff
+	var err error
+	var verifyErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			log.Printf("[joinSeeds] No seed let the node in, retry in %s\n", backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		for _, seed := range seeds {
+			err = node.joinChord(seed)
+			if err == nil {
+				err = node.verifyJoin()
+				if err == nil {
+					return nil
+				}
+				// the seed answered, the Chord did not take the node in
+				verifyErr = err
+			}
+			log.Printf("[joinSeeds] Failed to join through %s: %s\n", seed, err)
+			if errors.Is(err, ErrJoinRefused) {
+				return err
+			}
+		}
+	}
+	if verifyErr != nil {
+		return fmt.Errorf("%w after %d attempts: %s", ErrJoinNotVerified, attempts, verifyErr)
+	}
+	return fmt.Errorf("%w after %d attempts: %s", ErrNoSeedReachable, attempts, err)
+}
+
+// verifyJoin checks that the successor found by the join answers and took the node as its predecessor
+func (node *Node) verifyJoin() error {
+	successor, _ := node.successor()
+	if successor == node.Addr {
+		return errors.New("the Chord returned the node itself as its successor")
+	}
+	var getPredecessorRPCReply GetPredecessorRPCReply
+	err := node.call(successor, "Node.GetPredecessorRPC", struct{}{}, &getPredecessorRPCReply)
+	if err != nil {
+		return err
+	}
+	if getPredecessorRPCReply.PredecessorAddr != node.Addr {
+		return fmt.Errorf("the successor %s did not take the node as its predecessor, its predecessor is %s",
+			successor, getPredecessorRPCReply.PredecessorAddr)
+	}
+	return nil
+}
+
+// nodeFolder is the folder of the node under the storage root, which holds its keys, state and files
+func (node *Node) nodeFolder() string {
+	return node.options.StorageRoot + "/" + "N" + node.Identifier.String()
+}
+
+// Folder returns the folder of the node under StorageRoot, a program embedding the node may keep its own files there
+func (node *Node) Folder() string {
+	return node.nodeFolder()
+}
+
+// leaveChord leaves the Chord voluntarily
+// the files of the bucket are handed over to the successor, then the predecessor adopts the successor list of the node
+// and the successor adopts the predecessor of the node, so that the ring does not wait for the failure to be detected
+func (node *Node) leaveChord() error {
+	log.Printf("Node %s wanna leave the Chord", node.Addr)
+
+	//the successor list without the node itself
+	node.mutex.RLock()
+	successorList := make([]string, len(node.SuccessorsAddr))
+	successorIds := make([]*big.Int, len(node.SuccessorsAddr))
+	j := 0
+	for i := 0; i < len(node.SuccessorsAddr); i++ {
+		if node.SuccessorsAddr[i] != "" && node.SuccessorsAddr[i] != node.Addr {
+			successorList[j] = node.SuccessorsAddr[i]
+			successorIds[j] = node.SuccessorsId[i]
+			j++
+		}
+	}
+	predecessorAddr := node.PredecessorAddr
+	predecessorId := node.PredecessorId
+	bucket := node.copyBucket()
+	node.mutex.RUnlock()
+	successorAddr := successorList[0]
+	if successorAddr == "" {
+		//the last node of the Chord
+		return nil
+	}
+
+	//hand over the bucket to the successor
+	var err error
+	for k, v := range bucket {
+		err = node.sendSiblings(successorAddr, k, v, false, true)
+		if err != nil {
+			log.Println("[leaveChord] Hand over file error: ", err)
+			continue
+		}
+		node.mutex.Lock()
+		delete(node.Bucket, k)
+		node.mutex.Unlock()
+	}
+	node.mutex.RLock()
+	remaining := len(node.Bucket)
+	node.mutex.RUnlock()
+	if remaining != 0 {
+		err = fmt.Errorf("%d files could not be handed over to %s", remaining, successorAddr)
+	}
+
+	if predecessorAddr != "" && predecessorAddr != node.Addr {
+		var setSuccessorListRPCReply SetSuccessorListRPCReply
+		errPredecessor := node.call(predecessorAddr, "Node.SetSuccessorListRPC", SetSuccessorListRPCArgs{SuccessorList: successorList, SuccessorIds: successorIds}, &setSuccessorListRPCReply)
+		if errPredecessor != nil {
+			log.Println("[leaveChord] Set successor list of predecessor error: ", errPredecessor)
+			err = errPredecessor
+		}
+	}
+
+	//the successor is the last node of the Chord if it is also the predecessor
+	if predecessorAddr == successorAddr {
+		predecessorAddr = ""
+		predecessorId = nil
+	}
+	var setPredecessorRPCReply SetPredecessorRPCReply
+	errSuccessor := node.call(successorAddr, "Node.SetPredecessorRPC", SetPredecessorRPCArgs{Addr: predecessorAddr, Identifier: predecessorId}, &setPredecessorRPCReply)
+	if errSuccessor != nil {
+		log.Println("[leaveChord] Set predecessor of successor error: ", errSuccessor)
+		err = errSuccessor
+	}
+	return err
+}
+
+func (node *Node) PrintState() {
+	taskStats := node.TaskStats()
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	fmt.Println("-------------- Current Node State ------------")
+	fmt.Println("Node Name: ", node.Name)
+	fmt.Println("Node Address: ", node.Addr)
+	fmt.Println("Node Identifier: ", new(big.Int).SetBytes(node.Identifier.Bytes()))
+	fmt.Println("Identifier Bits: ", node.M)
+	fmt.Println("Node Predecessor: ", node.PredecessorAddr, ", id: ", node.PredecessorId)
+	fmt.Println("Node Successors: ")
+	for i := 0; i < len(node.SuccessorsAddr); i++ {
+		fmt.Println("Successor ", i, " address: ", node.SuccessorsAddr[i], ", id: ", node.SuccessorsId[i])
+	}
+	fmt.Println("Node Finger Table: ")
+	for i := 1; i < node.M+1; i++ {
+		item := node.FingerTable[i]
+		id := new(big.Int).SetBytes(item.Identifier)
+		address := item.Addr
+		fmt.Println("Finger ", i, " id: ", id, ", address: ", address, ", node id: ", item.NodeId)
+
+	}
+	fmt.Println("Node bucket: ", node.Bucket)
+	fmt.Println("Node Backup: ", node.Backup)
+	fmt.Println("Node Tombstone: ", node.Tombstone)
+	fmt.Println("Node Versions: ", node.Siblings)
+	fmt.Println("Maintenance Tasks: ")
+	for _, name := range []string{"stabilize", "fixFingers", "checkPredecessor", "antiEntropy", "handBack", "sweepTransfers"} {
+		stats, ok := taskStats[name]
+		if !ok {
+			continue
+		}
+		fmt.Println("Task ", name, " runs: ", stats.Runs, ", failures: ", stats.Failures,
+			", last duration: ", stats.LastDuration, ", max duration: ", stats.MaxDuration, ", delay: ", stats.Delay)
+	}
+}
+
+// copyBucket returns a copy of the bucket, so that files can be sent without holding the lock
+// the caller holds the lock
+func (node *Node) copyBucket() map[*big.Int]string {
+	bucket := make(map[*big.Int]string, len(node.Bucket))
+	for k, v := range node.Bucket {
+		bucket[k] = v
+	}
+	return bucket
+}
+
+// fileSiblings returns the versions of the file of the Bucket or the Backup
+func (node *Node) fileSiblings(fileName string) []VectorClock {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return append([]VectorClock{}, node.Siblings[fileName]...)
+}
+
+// fileDigests returns the digest of every version of the file, the caller holds the lock
+func (node *Node) fileDigests(id *big.Int, fileName string) []FileDigest {
+	digests := make([]FileDigest, 0, len(node.Siblings[fileName]))
+	for _, clock := range node.Siblings[fileName] {
+		digests = append(digests, FileDigest{Id: id, Name: fileName, Clock: clock})
+	}
+	return digests
+}
+
+// siblingPath returns where a version of the file is kept in the chord storage
+func (node *Node) siblingPath(fileName string, clock VectorClock) string {
+	return node.nodeFolder() + "/chord_storage/" + siblingFile(fileName, clock)
+}
+
+// siblingFile returns the name of the file holding a version of the file in the chord storage
+func siblingFile(fileName string, clock VectorClock) string {
+	return fileName + "." + clock.key()
+}
+
+// nextClock returns the version of a write of the node, which descends the context
+func (node *Node) nextClock(context VectorClock) VectorClock {
+	writer := node.Identifier.String()
+	clock := VectorClock{}.Merge(context)
+	node.mutex.Lock()
+	if node.writes < clock[writer] {
+		node.writes = clock[writer]
+	}
+	node.writes++
+	clock[writer] = node.writes
+	node.mutex.Unlock()
+	node.saveState()
+	return clock
+}
+
+// fileContext returns the versions of the file that the node has read or written, nil if there is none
+func (node *Node) fileContext(fileName string) VectorClock {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return node.contexts[fileName]
+}
+
+// setContext records the version that the node has written
+func (node *Node) setContext(fileName string, clock VectorClock) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.contexts[fileName] = clock
+}
+
+// mergeContext records the versions that the node has read
+func (node *Node) mergeContext(fileName string, clock VectorClock) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.contexts[fileName] = clock.Merge(node.contexts[fileName])
+}
+
+// successor returns the first entry of the successor list and its identifier
+func (node *Node) successor() (string, *big.Int) {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return node.SuccessorsAddr[0], node.SuccessorsId[0]
+}
+
+// membershipChanged records a change of the predecessor, the successors or the fingers,
+// and wakes the maintenance tasks up, so that the ring converges quickly after a join or a failure
+// the caller holds the lock
+func (node *Node) membershipChanged() {
+	node.ringChanges++
+	for _, executor := range node.executors {
+		executor.Wake()
+	}
+}
+
+// membershipChanges returns the number of changes recorded by membershipChanged
+func (node *Node) membershipChanges() uint64 {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return node.ringChanges
+}
+
+// predecessor returns the address of the predecessor and its identifier, empty if it is unknown
+func (node *Node) predecessor() (string, *big.Int) {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return node.PredecessorAddr, node.PredecessorId
+}
@@ -0,0 +1,105 @@
+package chord
+
+import (
+	"errors"
+	"log"
+	"math/big"
+	"strings"
+)
+
+// Consistency tells how many of the N copies of a file a read or a write waits for
+// N is the owner of the file plus the Replicas successors holding its backup
+type Consistency int
+
+const (
+	// ConsistencyOne waits for one copy, the first node that stores a write or answers a read
+	ConsistencyOne Consistency = iota
+	// ConsistencyQuorum waits for a majority of the N copies, so a quorum read overlaps every quorum write
+	ConsistencyQuorum
+	// ConsistencyAll waits for all the N copies
+	ConsistencyAll
+)
+
+func (consistency Consistency) String() string {
+	switch consistency {
+	case ConsistencyQuorum:
+		return "QUORUM"
+	case ConsistencyAll:
+		return "ALL"
+	}
+	return "ONE"
+}
+
+// ParseConsistency returns the consistency level named "ONE", "QUORUM" or "ALL", in any case
+func ParseConsistency(name string) (Consistency, error) {
+	switch strings.ToUpper(name) {
+	case "ONE":
+		return ConsistencyOne, nil
+	case "QUORUM":
+		return ConsistencyQuorum, nil
+	case "ALL":
+		return ConsistencyAll, nil
+	}
+	return ConsistencyOne, errors.New("unknown consistency level: " + name)
+}
+
+// required returns the number of the n copies the consistency level waits for, R or W
+func (consistency Consistency) required(n int) int {
+	switch consistency {
+	case ConsistencyQuorum:
+		return n/2 + 1
+	case ConsistencyAll:
+		return n
+	}
+	return 1
+}
+
+// copies returns N, the number of the nodes holding a file
+func (node *Node) copies() int {
+	return node.options.Replicas + 1
+}
+
+// replicaSet returns the owner of the id and its next successors, up to n nodes, which hold the copies of a file
+// every node is found by a lookup, so the nodes which have failed are skipped once the Chord has stabilized
+func (node *Node) replicaSet(id *big.Int, n int) []string {
+	var set []string
+	trace := node.lookupTrace(id)
+	for trace.Successor != "" && len(set) < n && !contains(set, trace.Successor) {
+		set = append(set, trace.Successor)
+		if trace.SuccessorId == nil {
+			break
+		}
+		trace = node.lookupTrace(new(big.Int).Add(trace.SuccessorId, big.NewInt(1)))
+	}
+	return set
+}
+
+// writeCopies sends a file written by the node to the replicas at once, the first of them is the owner of the file
+// and the others store it in their backup; it returns when w of them have stored it, or all of them have answered
+// every copy is a transfer of its own, so a large file is not bound by the timeout of a call, and a write still
+// succeeds when the owner is down; the copies which are not waited for go on in the background
+func (node *Node) writeCopies(replicas []string, f FileStructure, filePath string, w int) (int, error) {
+	results := make(chan error, len(replicas))
+	for i, addr := range replicas {
+		go func(addr string, backUp bool) {
+			results <- node.sendFile(addr, f, filePath, backUp, false)
+		}(addr, i > 0)
+	}
+	acks := 0
+	var firstErr error
+	for range replicas {
+		if acks >= w {
+			break
+		}
+		err := <-results
+		if err != nil {
+			log.Println("[writeCopies] Store the copy error: ", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		acks++
+	}
+	return acks, firstErr
+}
@@ -0,0 +1,1244 @@
+package chord
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+)
+
+type GetIDRPCReply struct {
+	Identifier *big.Int
+}
+
+func (node *Node) GetIDRPC(none string, reply *GetIDRPCReply) error {
+	reply.Identifier = node.Identifier
+	return nil
+}
+
+type GetIdentifierBitsRPCReply struct {
+	M int
+}
+
+func (node *Node) GetIdentifierBitsRPC(none string, reply *GetIdentifierBitsRPCReply) error {
+	reply.M = node.M
+	return nil
+}
+
+type NotifyRPCArgs struct {
+	Addr       string
+	Identifier *big.Int // the identifier of the node at Addr
+}
+
+type NotifyRPCReply struct {
+	Success bool
+}
+
+// change the predecessor of the node to addr
+func (node *Node) notify(addr string, addrId *big.Int) bool {
+	predecessorAddr, predecessorId := node.predecessor()
+	if predecessorAddr != "" && predecessorId != nil && !between(predecessorId, addrId, node.Identifier, false) {
+		return false
+	}
+	return node.replacePredecessor(predecessorAddr, addr, addrId)
+}
+
+// replacePredecessor changes the predecessor from oldAddr to addr
+// nothing is changed if the predecessor has been changed by someone else since it was read
+func (node *Node) replacePredecessor(oldAddr string, addr string, addrId *big.Int) bool {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.PredecessorAddr != oldAddr {
+		return false
+	}
+	node.PredecessorId = addrId
+	if addr != oldAddr {
+		node.PredecessorAddr = addr
+		node.membershipChanged()
+	}
+	// log.Println(node.Name, "'s Predecessor is set to ", addr)
+	return true
+}
+
+func (node *Node) NotifyRPC(args NotifyRPCArgs, reply *NotifyRPCReply) error {
+	if args.Identifier == nil {
+		return errors.New("the identifier of the notifying node is empty")
+	}
+	if args.Identifier.Cmp(node.Identifier) == 0 && args.Addr != node.Addr {
+		return fmt.Errorf("identifier %s is already used by node %s", args.Identifier, node.Addr)
+	}
+	node.unsuspect(args.Addr)
+	//todo:move files
+	if successor, _ := node.successor(); successor != node.Addr {
+		node.moveFiles(args.Addr, args.Identifier)
+	}
+
+	reply.Success = node.notify(args.Addr, args.Identifier)
+	return nil
+}
+
+type GetSuccessorListRPCReply struct {
+	SuccessorList []string
+	SuccessorIds  []*big.Int
+}
+
+func (node *Node) GetSuccessorListRPC(none *struct{}, reply *GetSuccessorListRPCReply) error {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	reply.SuccessorList = append([]string{}, node.SuccessorsAddr...)
+	reply.SuccessorIds = append([]*big.Int{}, node.SuccessorsId...)
+	return nil
+}
+
+type SetSuccessorListRPCArgs struct {
+	SuccessorList []string
+	SuccessorIds  []*big.Int
+}
+
+type SetSuccessorListRPCReply struct {
+	Success bool
+}
+
+// SetSuccessorListRPC adopt the successor list of the successor, which is leaving the Chord
+func (node *Node) SetSuccessorListRPC(args SetSuccessorListRPCArgs, reply *SetSuccessorListRPCReply) error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	for i := 0; i < len(node.SuccessorsAddr); i++ {
+		if i < len(args.SuccessorList) && args.SuccessorList[i] != "" && i < len(args.SuccessorIds) && args.SuccessorIds[i] != nil {
+			node.SuccessorsAddr[i] = args.SuccessorList[i]
+			node.SuccessorsId[i] = args.SuccessorIds[i]
+		} else {
+			node.SuccessorsAddr[i] = ""
+			node.SuccessorsId[i] = nil
+		}
+	}
+	if node.SuccessorsAddr[0] == "" {
+		node.SuccessorsAddr[0] = node.Addr
+		node.SuccessorsId[0] = node.Identifier
+	}
+	node.membershipChanged()
+	reply.Success = true
+	return nil
+}
+
+type GetPredecessorRPCReply struct {
+	PredecessorAddr string
+	PredecessorId   *big.Int
+}
+
+func (node *Node) GetPredecessorRPC(none *struct{}, reply *GetPredecessorRPCReply) error {
+	reply.PredecessorAddr, reply.PredecessorId = node.predecessor()
+	if reply.PredecessorAddr == "" {
+		return errors.New("predecessor is empty")
+	} else {
+		return nil
+	}
+}
+
+type LookupReply struct {
+	Found         bool
+	SuccessorAddr string
+}
+
+// LookupHop is a node that a lookup went through
+type LookupHop struct {
+	Id      *big.Int // nil if the node did not answer
+	Addr    string
+	Latency time.Duration // the time spent to reach the node and get its answer, without the later hops
+	Error   string        // the node did not answer, or failed to forward the lookup
+}
+
+// LookupTrace is the path of a lookup, see Node.Trace
+type LookupTrace struct {
+	Id          *big.Int
+	Mode        LookupMode
+	Successor   string   // the node responsible for the id, empty if the lookup failed
+	SuccessorId *big.Int // the identifier of the Successor
+	Hops        []LookupHop
+	Duration    time.Duration
+}
+
+// lookupRecursive asks the start node to find the successor of the id through FindSuccessorRPC
+// every node the query is forwarded to adds itself to the hops of the reply
+func (node *Node) lookupRecursive(id *big.Int, startNode string) LookupTrace {
+	//log.Println("---------------Invocation of Lookup start------------------")
+	//the id is reduced into the chord space by the node that handles FindSuccessorRPC
+	trace := LookupTrace{Id: id, Mode: RecursiveLookup}
+	result := FindSuccessorRPCReply{}
+	start := time.Now()
+	err := node.call(startNode, "Node.FindSuccessorRPC", id, &result)
+	trace.Duration = time.Since(start)
+	if err != nil {
+		log.Printf("[Lookup] Find successor rpc error: %s\n", err)
+		trace.Hops = []LookupHop{{Addr: startNode, Latency: trace.Duration, Error: err.Error()}}
+		return trace
+	}
+	setHopLatency(result.Hops, trace.Duration)
+	trace.Hops = result.Hops
+	trace.Successor = result.SuccessorAddress
+	trace.SuccessorId = result.SuccessorId
+	return trace
+}
+
+// setHopLatency sets the latency of the first hop to the time of the call without the later hops
+func setHopLatency(hops []LookupHop, elapsed time.Duration) {
+	if len(hops) == 0 {
+		return
+	}
+	for _, hop := range hops[1:] {
+		elapsed -= hop.Latency
+	}
+	hops[0].Latency = elapsed
+}
+
+/*
+FindSuccessorRPCReply function reply and its implementation
+*/
+
+type FindSuccessorRPCReply struct {
+	Found            bool
+	SuccessorAddress string
+	SuccessorId      *big.Int
+	Hops             []LookupHop // the node that answered, then the nodes it forwarded the query to
+}
+
+type GetAddrRPCReply struct {
+	Addr string
+}
+
+func (node *Node) FindSuccessorRPC(id *big.Int, reply *FindSuccessorRPCReply) error {
+	//log.Println("---------------invocation of FindSuccessor----------------")
+	successor, successorId := node.liveSuccessor()
+	id.Mod(id, node.HashMod)
+
+	flag := between(node.Identifier, id, successorId, true)
+
+	reply.Found = false
+	reply.Hops = []LookupHop{{Id: node.Identifier, Addr: node.Addr}}
+	if flag {
+		// the id is between node and its successor
+		reply.Found = true
+		reply.SuccessorAddress = successor
+		reply.SuccessorId = successorId
+		return nil
+	}
+	// find the successor from fingertable, a node that does not answer is suspected and the next closest one is asked
+	for attempt := 0; attempt < len(node.FingerTable)+len(node.SuccessorsAddr); attempt++ {
+		successorAddr := node.LookupFingerTable(id)
+		if successorAddr == node.Addr {
+			break
+		}
+		findSuccessorRPCReply := FindSuccessorRPCReply{}
+		start := time.Now()
+		err := node.call(successorAddr, "Node.FindSuccessorRPC", id, &findSuccessorRPCReply)
+		if err != nil {
+			log.Printf("[FindSuccessorRPC] Find successor rpc error: %s", err)
+			node.suspect(successorAddr)
+			reply.Hops = append(reply.Hops, LookupHop{Addr: successorAddr, Latency: time.Since(start), Error: err.Error()})
+			continue
+		}
+		setHopLatency(findSuccessorRPCReply.Hops, time.Since(start))
+		reply.Hops = append(reply.Hops, findSuccessorRPCReply.Hops...)
+		reply.Found = findSuccessorRPCReply.Found
+		reply.SuccessorAddress = findSuccessorRPCReply.SuccessorAddress
+		reply.SuccessorId = findSuccessorRPCReply.SuccessorId
+		return nil
+	}
+	// no closer node answers, the live successor is the closest node known
+	reply.Found = true
+	reply.SuccessorAddress = successor
+	reply.SuccessorId = successorId
+	return nil
+}
+
+func (node *Node) GetAddrRPC(none string, reply *GetAddrRPCReply) error {
+	reply.Addr = node.Addr
+	return nil
+}
+
+type SetPredecessorRPCArgs struct {
+	Addr       string
+	Identifier *big.Int // the identifier of the node at Addr, nil if Addr is empty
+}
+
+type SetPredecessorRPCReply struct {
+	Success bool
+}
+
+func (node *Node) SetPredecessorRPC(args SetPredecessorRPCArgs, reply *SetPredecessorRPCReply) error {
+	//fmt.Println("-------------- Invoke SetPredecessorRPC function ------------")
+	node.mutex.Lock()
+	node.PredecessorId = args.Identifier
+	if node.PredecessorAddr != args.Addr {
+		node.PredecessorAddr = args.Addr
+		node.membershipChanged()
+	}
+	node.mutex.Unlock()
+	reply.Success = true
+	return nil
+}
+
+// LookupFingerTable returns the closest node preceding the id, among the fingers and the successors
+// the suspected nodes are skipped, the successor is returned if none is left
+func (node *Node) LookupFingerTable(id *big.Int) string {
+	//log.Println("--------------invocation of LookupFingerTable--------------")
+	for _, addr := range node.closestPrecedingNodes(id) {
+		if node.isSuspected(addr) {
+			continue
+		}
+		return addr
+	}
+	successor, _ := node.liveSuccessor()
+	return successor
+}
+
+// closestPrecedingNodes returns the fingers and successors in (node, id), the closest to the id first
+// the suspected nodes come last
+func (node *Node) closestPrecedingNodes(id *big.Int) []string {
+	node.mutex.RLock()
+	known := make([]fingerItem, 0, len(node.FingerTable)+len(node.SuccessorsAddr))
+	for i := 1; i < len(node.FingerTable); i++ {
+		known = append(known, node.FingerTable[i])
+	}
+	for i, addr := range node.SuccessorsAddr {
+		known = append(known, fingerItem{Addr: addr, NodeId: node.SuccessorsId[i]})
+	}
+	suspected := make(map[string]bool)
+	for _, item := range known {
+		suspected[item.Addr] = node.suspected[item.Addr]
+	}
+	node.mutex.RUnlock()
+
+	var candidates []string
+	distance := make(map[string]*big.Int)
+	for _, item := range known {
+		addr, addrId := item.Addr, item.NodeId
+		if addr == "" || addrId == nil || addr == node.Addr || distance[addr] != nil {
+			continue
+		}
+		if !between(node.Identifier, addrId, id, false) {
+			continue
+		}
+		d := new(big.Int).Sub(id, addrId)
+		distance[addr] = d.Mod(d, node.HashMod)
+		candidates = append(candidates, addr)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if suspected[candidates[i]] != suspected[candidates[j]] {
+			return !suspected[candidates[i]]
+		}
+		return distance[candidates[i]].Cmp(distance[candidates[j]]) < 0
+	})
+	return candidates
+}
+
+// liveSuccessor returns the first successor which is not suspected, and its identifier
+// the node itself is returned if all are suspected
+func (node *Node) liveSuccessor() (string, *big.Int) {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	for i, addr := range node.SuccessorsAddr {
+		if addr == "" || node.SuccessorsId[i] == nil || node.suspected[addr] {
+			continue
+		}
+		return addr, node.SuccessorsId[i]
+	}
+	return node.Addr, node.Identifier
+}
+
+// suspect marks the node at addr as suspected dead, it is skipped by the lookups,
+// and the fingers pointing to it are replaced by the next FixFingers
+func (node *Node) suspect(addr string) {
+	if addr == "" || addr == node.Addr {
+		return
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if !node.suspected[addr] {
+		node.suspected[addr] = true
+		node.membershipChanged()
+	}
+}
+
+// unsuspect clears the suspicion of the node at addr, which answered
+func (node *Node) unsuspect(addr string) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	delete(node.suspected, addr)
+}
+
+// Call invokes serviceMethod of the node at addr through the transport of the node
+func (node *Node) Call(addr string, serviceMethod string, args interface{}, reply interface{}) error {
+	return node.call(addr, serviceMethod, args, reply)
+}
+
+// call invokes serviceMethod of the node at addr, a node that answers is no longer suspected
+func (node *Node) call(addr string, serviceMethod string, args interface{}, reply interface{}) error {
+	err := node.transport.Call(context.Background(), addr, serviceMethod, args, reply)
+	if err == nil && node.isSuspected(addr) {
+		node.unsuspect(addr)
+	}
+	return err
+}
+
+func (node *Node) isSuspected(addr string) bool {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return node.suspected[addr]
+}
+
+// LookupMode tells how the successor of a key is found
+type LookupMode int
+
+const (
+	// RecursiveLookup forwards the query from node to node through FindSuccessorRPC
+	RecursiveLookup LookupMode = iota
+	// IterativeLookup lets the originating node ask every hop for its closest preceding fingers and drive the search
+	IterativeLookup
+)
+
+// the maximum number of nodes asked by an iterative lookup
+const maxLookupHops = 2 * MaxIdentifierBits
+
+func (mode LookupMode) String() string {
+	if mode == IterativeLookup {
+		return "iterative"
+	}
+	return "recursive"
+}
+
+// ParseLookupMode returns the lookup mode named "recursive" or "iterative"
+func ParseLookupMode(name string) (LookupMode, error) {
+	switch name {
+	case "recursive":
+		return RecursiveLookup, nil
+	case "iterative":
+		return IterativeLookup, nil
+	}
+	return RecursiveLookup, errors.New("unknown lookup mode: " + name)
+}
+
+// lookup finds the successor of the id with the lookup mode of the node
+func (node *Node) lookup(id *big.Int) string {
+	return node.lookupTrace(id).Successor
+}
+
+// lookupTrace is lookup which returns the identifier of the successor along with its address
+func (node *Node) lookupTrace(id *big.Int) LookupTrace {
+	if node.options.LookupMode == IterativeLookup {
+		trace, err := node.traceIterative(id)
+		if err != nil {
+			log.Println("[lookup] Iterative lookup error: ", err)
+		}
+		return trace
+	}
+	return node.lookupRecursive(id, node.Addr)
+}
+
+// traceIterative finds the successor of the id by asking the nodes one by one, starting with the node itself,
+// and returns every node it asked
+// every hop returns the nodes it knows that precede the id, the closest first,
+// so when a hop does not answer, the next one of the previous reply is asked instead
+// if none of them answers, the id belongs to the first live successor of the last hop that answered
+func (node *Node) traceIterative(id *big.Int) (trace LookupTrace, err error) {
+	trace = LookupTrace{Id: id, Mode: IterativeLookup}
+	begin := time.Now()
+	defer func() {
+		trace.Duration = time.Since(begin)
+	}()
+	candidates := []string{node.Addr}
+	asked := make(map[string]bool)
+	failed := make(map[string]bool)
+	var last *ClosestPrecedingFingerRPCReply
+	for hops := 0; hops < maxLookupHops; hops++ {
+		var reply ClosestPrecedingFingerRPCReply
+		answered := false
+		for _, next := range candidates {
+			if asked[next] {
+				continue
+			}
+			asked[next] = true
+			reply = ClosestPrecedingFingerRPCReply{}
+			start := time.Now()
+			err := node.call(next, "Node.ClosestPrecedingFingerRPC", id, &reply)
+			hop := LookupHop{Id: reply.Identifier, Addr: next, Latency: time.Since(start)}
+			if err != nil {
+				hop.Error = err.Error()
+			}
+			trace.Hops = append(trace.Hops, hop)
+			if err != nil {
+				log.Printf("[traceIterative] Node %s does not answer, try the next one: %s\n", next, err)
+				node.suspect(next)
+				failed[next] = true
+				continue
+			}
+			answered = true
+			break
+		}
+		if !answered {
+			if last != nil {
+				for i, successor := range last.Successors {
+					if successor != "" && !failed[successor] && i < len(last.SuccessorIds) && last.SuccessorIds[i] != nil {
+						trace.Successor = successor
+						trace.SuccessorId = last.SuccessorIds[i]
+						return trace, nil
+					}
+				}
+			}
+			return trace, fmt.Errorf("no node answers the lookup of %s", id)
+		}
+		if reply.Found {
+			trace.Successor = reply.SuccessorAddress
+			trace.SuccessorId = reply.SuccessorId
+			return trace, nil
+		}
+		candidates = reply.Candidates
+		last = &reply
+	}
+	return trace, fmt.Errorf("the lookup of %s takes more than %d hops", id, maxLookupHops)
+}
+
+type ClosestPrecedingFingerRPCReply struct {
+	Identifier       *big.Int // the identifier of the node
+	Found            bool     // the id is between the node and its successor, which is SuccessorAddress
+	SuccessorAddress string
+	SuccessorId      *big.Int
+	Candidates       []string   // the fingers and successors preceding the id, the closest first
+	Successors       []string   // the successor list of the node
+	SuccessorIds     []*big.Int // the identifiers of the Successors
+}
+
+// ClosestPrecedingFingerRPC is one hop of an iterative lookup
+func (node *Node) ClosestPrecedingFingerRPC(id *big.Int, reply *ClosestPrecedingFingerRPCReply) error {
+	id.Mod(id, node.HashMod)
+	reply.Identifier = node.Identifier
+	successor, successorId := node.liveSuccessor()
+	node.mutex.RLock()
+	reply.Successors = append([]string{}, node.SuccessorsAddr...)
+	reply.SuccessorIds = append([]*big.Int{}, node.SuccessorsId...)
+	node.mutex.RUnlock()
+
+	if between(node.Identifier, id, successorId, true) {
+		reply.Found = true
+		reply.SuccessorAddress = successor
+		reply.SuccessorId = successorId
+		return nil
+	}
+
+	reply.Candidates = node.closestPrecedingNodes(id)
+	if len(reply.Candidates) == 0 {
+		// no finger precedes the id, the successor is the closest node known
+		reply.Candidates = []string{successor}
+	}
+	return nil
+}
+
+type GetPublicKeyRPCReply struct {
+	Public_Key *rsa.PublicKey
+}
+
+func (node *Node) GetPublicKeyRPC(none string, reply *GetPublicKeyRPCReply) error {
+	reply.Public_Key = node.PublicKey
+	return nil
+}
+
+type FileStructure struct {
+	Id   *big.Int
+	Name string // the name of the file in the Chord, its id is the hash of it
+	Size int64  // the content is transferred in chunks, see sendFile
+
+	Clock VectorClock // the version of the file, the versions of a file that no other version descends are its siblings
+
+	EncryptedKey []byte // the AES data key of the transfer, wrapped with the public key of the receiver
+}
+
+func StoreFile(fileName string, node *Node, content io.Reader) error {
+	_, err := StoreFileWithConsistency(fileName, node, content, node.options.WriteConsistency)
+	return err
+}
+
+// StoreFileWithConsistency writes the file over the versions that the node has read or written, see StoreFileWithContext
+func StoreFileWithConsistency(fileName string, node *Node, content io.Reader, consistency Consistency) (int, error) {
+	return StoreFileWithContext(fileName, node, content, node.fileContext(fileName), consistency)
+}
+
+// StoreFileWithContext uploads the content of the file to the node who is responsible for it and to the successors holding its backup
+// the new version descends the context, the versions of the file the writer has seen, e.g. the siblings returned by a
+// read, and replaces them; the versions written concurrently, which the writer has not seen, are kept as siblings
+// the write succeeds once W of the N copies are stored, W is given by the consistency level
+// it returns the number of the copies that acknowledged the write, a failed write may still have stored some
+func StoreFileWithContext(fileName string, node *Node, content io.Reader, context VectorClock, consistency Consistency) (int, error) {
+	// find which nodes should this file stored
+	key := StrHash(fileName)
+	replicas := node.replicaSet(key, node.copies())
+	if len(replicas) == 0 {
+		return 0, errors.New("no node is found for the file " + fileName)
+	}
+	// upload the file to them
+	filePath, err := node.spoolContent(content)
+	if err != nil {
+		log.Println("[StoreFile] Failed to read the content: ", err)
+		return 0, err
+	}
+	defer os.Remove(filePath)
+
+	newFile := FileStructure{}
+	newFile.Name = fileName
+	newFile.Id = new(big.Int).Mod(key, node.HashMod)
+	newFile.Clock = node.nextClock(context)
+
+	w := consistency.required(node.copies())
+	acks, err := node.writeCopies(replicas, newFile, filePath, w)
+	if acks == 0 {
+		return 0, err
+	}
+	node.setContext(fileName, newFile.Clock)
+	if acks < w {
+		return acks, fmt.Errorf("the file %s is stored at %d of %d nodes, %s needs %d", fileName, acks, node.copies(), consistency, w)
+	}
+	return acks, nil
+}
+
+// spoolContent copies the content to be written into a file of the node, the file is sent to every copy chunk by chunk,
+// and a send that was interrupted is resumed from it, see sendFile; the caller removes the file
+func (node *Node) spoolContent(content io.Reader) (string, error) {
+	err := os.MkdirAll(node.nodeFolder()+"/outgoing", os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(node.nodeFolder()+"/outgoing", "put-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, content)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// storeFile add the received file to the bucket, or to the backup
+// the content has been reassembled at transferPath, and is moved into the chord storage
+// a handoff is a file copied between the nodes, not a write of a client
+func (node *Node) storeFile(f FileStructure, backUp bool, handoff bool, transferPath string) error {
+	// Store the file in the bucket
+	// Return nil if success, the error if failed
+	err := node.putFile(f, backUp, handoff, transferPath)
+	if err != nil {
+		return err
+	}
+	node.saveState()
+	return nil
+}
+
+// putFile append the version of the file to the bucket or the backup, and move it into the chord storage
+// the versions that the new one descends are replaced, the concurrent ones are kept as its siblings
+func (node *Node) putFile(f FileStructure, backUp bool, handoff bool, transferPath string) error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if !backUp && handoff && containsKey(node.Tombstone, f.Id) {
+		// the file was deleted while a stale copy was handed over, do not resurrect it
+		os.Remove(transferPath)
+		return nil
+	}
+	files := node.Bucket
+	tombstone := node.Tombstone
+	if backUp {
+		files = node.Backup
+		tombstone = node.BackupTombstone
+	}
+	// the versions are shared by the Bucket and the Backup, a version that one of them holds is only recorded in the other
+	siblings, dropped, added := addSibling(node.Siblings[f.Name], f.Clock)
+	if !added {
+		// this version, or one which descends it, is stored already
+		os.Remove(transferPath)
+		if containsKey(files, f.Id) {
+			return nil
+		}
+	} else {
+		err := os.Rename(transferPath, node.siblingPath(f.Name, f.Clock))
+		if err != nil {
+			log.Println("Move file error: ", err)
+			return err
+		}
+		for _, clock := range dropped {
+			os.Remove(node.siblingPath(f.Name, clock))
+		}
+		node.Siblings[f.Name] = siblings
+	}
+
+	if !handoff {
+		// the file is stored again by a client after being deleted
+		for k, _ := range tombstone {
+			if k.Cmp(f.Id) == 0 {
+				delete(tombstone, k)
+			}
+		}
+		if !backUp {
+			delete(node.tombstoneAcks, f.Name)
+		}
+	}
+	for k, _ := range files {
+		if k.Cmp(f.Id) == 0 {
+			delete(files, k)
+		}
+	}
+	files[f.Id] = f.Name
+	if backUp {
+		fmt.Println("Store Backup: ", node.Backup)
+	} else {
+		fmt.Println("Store Bucket: ", node.Bucket)
+	}
+	return nil
+}
+
+type CheckFileExistRPCReply struct {
+	Exist bool
+}
+
+func (node *Node) CheckFileExistRPC(fileName string, reply *CheckFileExistRPCReply) error {
+	//log.Println("----------------invocation of checkfileexistRPC---------------")
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	for _, value := range node.Bucket {
+		if fileName == value {
+			reply.Exist = true
+			return nil
+		}
+	}
+	reply.Exist = false
+	return nil
+}
+
+type FetchFileRPCReply struct {
+	Found    bool
+	Backup   bool            // the file is served from the Backup instead of the Bucket
+	Siblings []FileStructure // every version of the file, with its clock and size
+}
+
+// ErrConcurrentVersions is returned by a read of a single version when the file has several written concurrently,
+// GetSiblings returns all of them
+var ErrConcurrentVersions = errors.New("the file has concurrent versions")
+
+// Sibling is a version of a file downloaded by a read, a read returns all the versions written concurrently
+type Sibling struct {
+	Clock   VectorClock
+	Content []byte
+}
+
+// FetchFile download the file from the node who is responsible for it, and writes its content to w
+func FetchFile(fileName string, node *Node, w io.Writer) error {
+	_, err := FetchFileWithConsistency(fileName, node, w, node.options.ReadConsistency)
+	return err
+}
+
+// FetchFileWithConsistency downloads the file like FetchSiblings, writes its content to w,
+// and returns the number of the copies that answered
+// ErrConcurrentVersions is returned if the file has several versions, nothing is written then
+func FetchFileWithConsistency(fileName string, node *Node, w io.Writer, consistency Consistency) (int, error) {
+	versions, paths, answered, err := node.downloadVersions(fileName, consistency)
+	if err != nil {
+		return answered, err
+	}
+	defer removeAll(paths)
+	if len(versions) > 1 {
+		return answered, fmt.Errorf("%w: %s has %d", ErrConcurrentVersions, fileName, len(versions))
+	}
+	file, err := os.Open(paths[0])
+	if err != nil {
+		return answered, err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return answered, err
+}
+
+// FetchSiblings downloads every version of the file that no other version descends, see downloadVersions,
+// it returns the siblings with their content and the number of the copies that answered
+func FetchSiblings(fileName string, node *Node, consistency Consistency) ([]Sibling, int, error) {
+	versions, paths, answered, err := node.downloadVersions(fileName, consistency)
+	if err != nil {
+		return nil, answered, err
+	}
+	defer removeAll(paths)
+	siblings := make([]Sibling, 0, len(versions))
+	for i, f := range versions {
+		content, err := os.ReadFile(paths[i])
+		if err != nil {
+			return nil, answered, err
+		}
+		siblings = append(siblings, Sibling{Clock: f.Clock, Content: content})
+	}
+	return siblings, answered, nil
+}
+
+func removeAll(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// downloadVersions asks the owner of the file and its successors who hold the Backup copies, one by one,
+// until R of them have answered, R is given by the consistency level, a node which is down is skipped
+// the versions among the answers that no other version descends are downloaded, and a download is resumed from
+// where a previous node stopped, see fetchFile
+// the node remembers the versions, so that its next write of the file replaces them
+// it returns the versions, the files they are downloaded to, which the caller removes, and the number of the copies that answered
+func (node *Node) downloadVersions(fileName string, consistency Consistency) ([]FileStructure, []string, int, error) {
+	key := StrHash(fileName)
+	r := consistency.required(node.copies())
+	replicas := node.replicaSet(key, node.copies())
+	if len(replicas) == 0 {
+		return nil, nil, 0, errors.New("no node is found for the file " + fileName)
+	}
+
+	type holder struct {
+		addr   string
+		backup bool
+	}
+	answered := 0
+	var versions []FileStructure
+	holders := make(map[string][]holder) // the nodes holding every version, by clock
+	for _, addr := range replicas {
+		if answered >= r {
+			break
+		}
+		fetchReply := FetchFileRPCReply{}
+		err := node.call(addr, "Node.FetchFileRPC", fileName, &fetchReply)
+		if err != nil {
+			log.Printf("[FetchFile] Node %s cannot be reached, try its successor: %s\n", addr, err)
+			continue
+		}
+		answered++
+		for _, f := range fetchReply.Siblings {
+			clock := f.Clock.String()
+			if _, ok := holders[clock]; !ok {
+				versions = append(versions, f)
+			}
+			holders[clock] = append(holders[clock], holder{addr: addr, backup: fetchReply.Backup})
+		}
+	}
+	if answered < r {
+		return nil, nil, answered, fmt.Errorf("%d of %d nodes holding the file %s answered, %s needs %d", answered, node.copies(), fileName, consistency, r)
+	}
+
+	// a copy that missed a write answers an older version, which the newer one descends
+	var latest []FileStructure
+	for i, f := range versions {
+		obsolete := false
+		for j, other := range versions {
+			if i != j && other.Clock.Descends(f.Clock) {
+				obsolete = true
+			}
+		}
+		if !obsolete {
+			latest = append(latest, f)
+		}
+	}
+	if len(latest) == 0 {
+		return nil, nil, answered, fmt.Errorf("the file %s is not stored at any of the %d nodes that answered", fileName, answered)
+	}
+	sort.Slice(latest, func(i, j int) bool {
+		return latest[i].Clock.String() < latest[j].Clock.String()
+	})
+
+	paths := make([]string, 0, len(latest))
+	for _, f := range latest {
+		var path string
+		var err error
+		for _, h := range holders[f.Clock.String()] {
+			path, err = node.fetchFile(h.addr, f)
+			if err == nil {
+				if h.backup {
+					log.Printf("[FetchFile] File %s is fetched from the backup at node: %s\n", fileName, h.addr)
+				}
+				break
+			}
+			log.Printf("[FetchFile] Failed to download from %s, try another copy: %s\n", h.addr, err)
+		}
+		if err != nil {
+			return nil, nil, answered, err
+		}
+		paths = append(paths, path)
+	}
+	context := VectorClock{}
+	for _, f := range latest {
+		context = context.Merge(f.Clock)
+	}
+	node.mergeContext(fileName, context)
+	return latest, paths, answered, nil
+}
+
+func (node *Node) FetchFileRPC(fileName string, reply *FetchFileRPCReply) error {
+	reply.Siblings, reply.Backup, reply.Found = node.findFile(fileName)
+	return nil
+}
+
+// findFile look for the file in the Bucket, then in the Backup, and returns every version of it
+func (node *Node) findFile(fileName string) ([]FileStructure, bool, bool) {
+	var id *big.Int
+	node.mutex.RLock()
+	for k, v := range node.Bucket {
+		if v == fileName {
+			id = k
+		}
+	}
+	backUp := false
+	if id == nil {
+		for k, v := range node.Backup {
+			if v == fileName {
+				id = k
+				backUp = true
+			}
+		}
+	}
+	clocks := append([]VectorClock{}, node.Siblings[fileName]...)
+	node.mutex.RUnlock()
+	if id == nil {
+		return nil, false, false
+	}
+	var siblings []FileStructure
+	for _, clock := range clocks {
+		info, err := os.Stat(node.siblingPath(fileName, clock))
+		if err != nil {
+			log.Println("[findFile] Stat file error: ", err)
+			continue
+		}
+		siblings = append(siblings, FileStructure{Id: id, Name: fileName, Size: info.Size(), Clock: clock})
+	}
+	return siblings, backUp, len(siblings) > 0
+}
+
+type DeleteFileRPCArgs struct {
+	FileName string
+	Backup   bool // delete the backup copy held by the successor of the owner
+}
+
+type DeleteFileRPCReply struct {
+	Success bool
+}
+
+// DeleteFile delete the file from the node who is responsible for it and from the backup of its successor
+func DeleteFile(fileName string, node *Node) error {
+	key := StrHash(fileName)
+	replicas := node.replicaSet(key, node.copies())
+	if len(replicas) == 0 {
+		return errors.New("no node is found for the file " + fileName)
+	}
+
+	// if the owner is down, the next node of the replica set records the tombstone,
+	// it takes the file over with the tombstone once the failure is detected
+	var err error
+	for _, addr := range replicas {
+		reply := DeleteFileRPCReply{}
+		err = node.call(addr, "Node.DeleteFileRPC", DeleteFileRPCArgs{FileName: fileName, Backup: false}, &reply)
+		if err != nil {
+			log.Printf("[DeleteFile] Node %s cannot be reached, try its successor: %s\n", addr, err)
+			continue
+		}
+		if !reply.Success {
+			return errors.New("the file " + fileName + " is not stored at node: " + addr)
+		}
+		return nil
+	}
+	return err
+}
+
+func (node *Node) DeleteFileRPC(args DeleteFileRPCArgs, reply *DeleteFileRPCReply) error {
+	reply.Success = node.deleteFile(args.FileName, args.Backup)
+	if !args.Backup {
+		// propagate the deletion to the backups of the successors
+		args.Backup = true
+		for _, target := range node.replicaTargets() {
+			err := node.call(target, "Node.DeleteFileRPC", args, &DeleteFileRPCReply{})
+			if err != nil {
+				log.Println("[DeleteFileRPC] Delete successor's backup error: ", err)
+				continue
+			}
+			node.ackTombstones(target, []string{args.FileName})
+		}
+	}
+	return nil
+}
+
+// deleteFile remove the file from the Bucket or Backup and record a tombstone for it
+// the tombstone is recorded even if the file is not found, so that a late copy will not bring it back
+func (node *Node) deleteFile(fileName string, backUp bool) bool {
+	fileId := StrHash(fileName)
+	fileId.Mod(fileId, node.HashMod)
+
+	// saveState takes the lock, it runs after the lock is released
+	defer node.saveState()
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	files := node.Bucket
+	tombstone := node.Tombstone
+	if backUp {
+		files = node.Backup
+		tombstone = node.BackupTombstone
+	}
+	found := false
+	for k, v := range files {
+		if k.Cmp(fileId) == 0 && v == fileName {
+			delete(files, k)
+			found = true
+		}
+	}
+	if !backUp {
+		// a node of the replica set deleting for a failed owner holds the file in its backup,
+		// the tombstone keeps it from being promoted
+		found = found || containsKey(node.Backup, fileId)
+		node.tombstoneAcks[fileName] = &tombstoneAck{since: time.Now()}
+	}
+	for k, _ := range tombstone {
+		if k.Cmp(fileId) == 0 {
+			delete(tombstone, k)
+		}
+	}
+	tombstone[fileId] = fileName
+
+	// the file on disk is still needed if the node holds the other copy
+	for _, v := range node.Bucket {
+		if v == fileName {
+			return found
+		}
+	}
+	for _, v := range node.Backup {
+		if v == fileName {
+			return found
+		}
+	}
+	for _, clock := range node.Siblings[fileName] {
+		err := os.Remove(node.siblingPath(fileName, clock))
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("[deleteFile] Remove file error: ", err)
+		}
+	}
+	delete(node.Siblings, fileName)
+	return found
+}
+
+type DeleteSuccessorBackupRPCReply struct {
+	Success bool
+}
+
+// FileDigest identifies a version of a file, the owner and its backups compare them to sync the backups
+// a file with siblings has a digest for every version
+type FileDigest struct {
+	Id    *big.Int
+	Name  string
+	Clock VectorClock
+}
+
+type SyncBackupRPCArgs struct {
+	Owner     string   // the address of the owner, the versions that it lacks are handed back to it
+	Start     *big.Int // the range (Start, End] of the owner, nil if the predecessor of the owner is unknown
+	End       *big.Int
+	Files     []FileDigest // the bucket of the owner
+	Tombstone map[*big.Int]string
+}
+
+type SyncBackupRPCReply struct {
+	Missing []FileDigest // the versions of the files of the owner that the backup lacks
+}
+
+// SyncBackupRPC compares the backup of the range of a predecessor with the digest of its bucket
+// the files which the predecessor no longer holds are dropped, and the missing ones are returned to be sent
+// the versions that the predecessor has never held, e.g. a write that reached the backups only, are handed back to it
+func (node *Node) SyncBackupRPC(args SyncBackupRPCArgs, reply *SyncBackupRPCReply) error {
+	missing, unknown := node.syncBackup(args)
+	reply.Missing = missing
+	node.saveState()
+	if len(unknown) > 0 && args.Owner != "" {
+		node.queueHandBack(args.Owner, unknown)
+	}
+	return nil
+}
+
+// handBackItem is a version of the backup that its owner lacks, see handBack
+type handBackItem struct {
+	owner string
+	file  FileDigest
+}
+
+// queueHandBack records the versions to be handed back to the owner, a version that is already queued is not queued twice
+func (node *Node) queueHandBack(owner string, versions []FileDigest) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	for _, f := range versions {
+		key := siblingFile(f.Name, f.Clock)
+		if _, ok := node.handBacks[key]; !ok {
+			node.handBacks[key] = &handBackItem{owner: owner, file: f}
+		}
+	}
+}
+
+// handBack sends the queued versions of the backup that the owner lacks to its bucket, one at a time
+// it runs as a maintenance task, so that no hand-back outlives Stop; a version stays queued while it is sent
+func (node *Node) handBack() error {
+	node.mutex.RLock()
+	items := make([]*handBackItem, 0, len(node.handBacks))
+	for _, item := range node.handBacks {
+		items = append(items, item)
+	}
+	node.mutex.RUnlock()
+
+	var firstErr error
+	for _, item := range items {
+		f := item.file
+		node.mutex.RLock()
+		held := hasClock(node.Siblings[f.Name], f.Clock)
+		node.mutex.RUnlock()
+		// the version may have been replaced meanwhile, the owner gets the newer one from the next sync
+		if held {
+			newFile := FileStructure{Id: f.Id, Name: f.Name, Clock: f.Clock}
+			err := node.sendFile(item.owner, newFile, node.siblingPath(f.Name, f.Clock), false, true)
+			if err != nil {
+				log.Printf("[handBack] Failed to hand %s back to %s: %s\n", f.Name, item.owner, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		node.mutex.Lock()
+		delete(node.handBacks, siblingFile(f.Name, f.Clock))
+		node.mutex.Unlock()
+	}
+	return firstErr
+}
+
+func (node *Node) syncBackup(args SyncBackupRPCArgs) (missing []FileDigest, unknown []FileDigest) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	inRange := func(key *big.Int) bool {
+		return args.Start != nil && args.End != nil && between(args.Start, key, args.End, true)
+	}
+	// the tombstones of the range are replaced with the tombstones of the owner
+	for key, _ := range node.BackupTombstone {
+		if inRange(key) {
+			delete(node.BackupTombstone, key)
+		}
+	}
+	for key, value := range args.Tombstone {
+		if !node.isBackupTombstone(key) {
+			node.BackupTombstone[key] = value
+		}
+	}
+
+	owned := make(map[string][]VectorClock, len(args.Files))
+	for _, f := range args.Files {
+		owned[f.Name] = append(owned[f.Name], f.Clock)
+	}
+	for key, name := range node.Backup {
+		clocks, ok := owned[name]
+		if !ok && !inRange(key) && !node.isBackupTombstone(key) {
+			continue
+		}
+		var kept []VectorClock
+		if !node.isBackupTombstone(key) {
+			// the versions that the owner holds a newer version of have been replaced,
+			// the versions that it does not know of are kept until it has them
+			for _, clock := range node.Siblings[name] {
+				if hasClock(clocks, clock) {
+					kept = append(kept, clock)
+				} else if !hasSibling(clocks, clock) {
+					kept = append(kept, clock)
+					unknown = append(unknown, FileDigest{Id: key, Name: name, Clock: clock})
+				}
+			}
+		}
+		if len(kept) > 0 {
+			node.Siblings[name] = kept
+		} else {
+			// we just remove the reference to the key, but the file still exists in local disk. It will be cleaned later
+			delete(node.Backup, key)
+		}
+	}
+	for _, f := range args.Files {
+		if node.isBackupTombstone(f.Id) || containsKey(node.Bucket, f.Id) {
+			continue
+		}
+		if containsKey(node.Backup, f.Id) && hasClock(node.Siblings[f.Name], f.Clock) {
+			continue
+		}
+		missing = append(missing, f)
+	}
+	return missing, unknown
+}
+
+type DeleteSuccessorBackupRPCArgs struct {
+	Start     *big.Int // the backup of (Start, End] is replaced, nil if the predecessor of the owner is unknown
+	End       *big.Int // the identifier of the owner
+	Tombstone map[*big.Int]string
+}
+
+// DeleteSuccessorBackupRPC wipes the backup of the files of a predecessor, and replaces the backup tombstones
+// of its range with its tombstones, a predecessor calls it when the node is no longer one of its replica targets
+func (node *Node) DeleteSuccessorBackupRPC(args DeleteSuccessorBackupRPCArgs, reply *DeleteSuccessorBackupRPCReply) error {
+	reply.Success = node.deleteSuccessorBackupRPC(args)
+	return nil
+}
+
+func (node *Node) deleteSuccessorBackupRPC(args DeleteSuccessorBackupRPCArgs) bool {
+	node.mutex.Lock()
+	if args.Start != nil && args.End != nil {
+		for key, _ := range node.Backup {
+			// we just remove the reference to the key, but the file still exists in local disk. It will be cleaned later
+			if between(args.Start, key, args.End, true) {
+				delete(node.Backup, key)
+			}
+		}
+		for key, _ := range node.BackupTombstone {
+			if between(args.Start, key, args.End, true) {
+				delete(node.BackupTombstone, key)
+			}
+		}
+	}
+	for key, value := range args.Tombstone {
+		for k, _ := range node.Backup {
+			if k.Cmp(key) == 0 {
+				delete(node.Backup, k)
+			}
+		}
+		if !node.isBackupTombstone(key) {
+			node.BackupTombstone[key] = value
+		}
+	}
+	node.mutex.Unlock()
+	node.saveState()
+	return true
+}
+
+// moveFiles hands the files which belong to the new predecessor over to it
+func (node *Node) moveFiles(addr string, addrId *big.Int) {
+	// iterate local bucket
+	node.mutex.RLock()
+	bucket := node.copyBucket()
+	node.mutex.RUnlock()
+	for k, v := range bucket {
+		fileId := k
+		fileName := v
+		if !between(fileId, addrId, node.Identifier, true) {
+			continue
+		}
+		err := node.sendSiblings(addr, fileId, fileName, false, true)
+		if err != nil {
+			// keep the file, the receiver could not store it
+			log.Println("[moveFiles] Move file error: ", err)
+			continue
+		}
+		// delete local file
+		node.mutex.Lock()
+		delete(node.Bucket, k)
+		node.mutex.Unlock()
+	}
+	node.saveState()
+}
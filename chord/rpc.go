@@ -0,0 +1,160 @@
+package chord
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+	"time"
+)
+
+const DefaultDialTimeout = 1000 * time.Millisecond
+const DefaultCallTimeout = 5000 * time.Millisecond
+
+// the number of idle connections kept for every peer
+const maxIdleConns = 4
+
+// RPCClient is the client side of TCPTransport, it keeps a pool of reusable jsonrpc clients for every peer
+// a connection is returned to the pool after a call, and closed if the call broke it
+type RPCClient struct {
+	DialTimeout time.Duration
+	CallTimeout time.Duration
+
+	mutex sync.Mutex
+	idle  map[string][]*rpc.Client // idle clients by peer address
+}
+
+func NewRPCClient(dialTimeout time.Duration, callTimeout time.Duration) *RPCClient {
+	return &RPCClient{
+		DialTimeout: dialTimeout,
+		CallTimeout: callTimeout,
+		idle:        make(map[string][]*rpc.Client),
+	}
+}
+
+/*
+targetNodeAddr: connect object
+serviceMethod: targetNodeAddr.serviceMethod and return reply
+args: arguments for serviceMethod
+reply: reply from serviceMethod
+*/
+func (c *RPCClient) Call(ctx context.Context, targetNodeAddr string, serviceMethod string, args interface{}, reply interface{}) error {
+	if _, port, err := net.SplitHostPort(targetNodeAddr); err != nil || port == "" {
+		log.Println("Node host:port address error!", targetNodeAddr)
+		return errors.New("Error: targetNode address is not in the correct format: " + string(targetNodeAddr))
+	}
+	if c.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.CallTimeout)
+		defer cancel()
+	}
+
+	client, pooled, err := c.get(ctx, targetNodeAddr)
+	if err != nil {
+		log.Println("Method: ", serviceMethod, "dial error: ", err)
+		return err
+	}
+	err = c.call(ctx, targetNodeAddr, client, serviceMethod, args, reply)
+	if err != nil && pooled && isBrokenConn(err) && ctx.Err() == nil {
+		// the idle connection was closed by the peer, e.g. it restarted, retry with a new one
+		client, err = c.dial(ctx, targetNodeAddr)
+		if err != nil {
+			log.Println("Method: ", serviceMethod, "dial error: ", err)
+			return err
+		}
+		err = c.call(ctx, targetNodeAddr, client, serviceMethod, args, reply)
+	}
+	if err != nil {
+		log.Println("Call error: ", err)
+		return err
+	}
+	return nil
+}
+
+// call invokes the method on client, the client is put back to the pool unless the connection is broken
+func (c *RPCClient) call(ctx context.Context, targetNodeAddr string, client *rpc.Client, serviceMethod string, args interface{}, reply interface{}) error {
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil && isBrokenConn(call.Error) {
+			client.Close()
+		} else {
+			c.put(targetNodeAddr, client)
+		}
+		// serviceMethod's error will pass to err
+		return call.Error
+	case <-ctx.Done():
+		// the reply may never come, do not reuse the connection
+		// closing it ends the call, so that the reply is not written after we return
+		client.Close()
+		<-call.Done
+		return ctx.Err()
+	}
+}
+
+// isBrokenConn tells whether the error is caused by the connection instead of the remote method
+func isBrokenConn(err error) bool {
+	var serverError rpc.ServerError
+	return !errors.As(err, &serverError)
+}
+
+// get returns an idle client of the peer, or dials a new one
+func (c *RPCClient) get(ctx context.Context, targetNodeAddr string) (*rpc.Client, bool, error) {
+	c.mutex.Lock()
+	clients := c.idle[targetNodeAddr]
+	if len(clients) > 0 {
+		client := clients[len(clients)-1]
+		c.idle[targetNodeAddr] = clients[:len(clients)-1]
+		c.mutex.Unlock()
+		return client, true, nil
+	}
+	c.mutex.Unlock()
+	client, err := c.dial(ctx, targetNodeAddr)
+	return client, false, err
+}
+
+func (c *RPCClient) dial(ctx context.Context, targetNodeAddr string) (*rpc.Client, error) {
+	dialer := net.Dialer{Timeout: c.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", targetNodeAddr)
+	if err != nil {
+		return nil, err
+	}
+	return jsonrpc.NewClient(conn), nil
+}
+
+func (c *RPCClient) put(targetNodeAddr string, client *rpc.Client) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.idle[targetNodeAddr]) >= maxIdleConns {
+		client.Close()
+		return
+	}
+	c.idle[targetNodeAddr] = append(c.idle[targetNodeAddr], client)
+}
+
+// Evict closes the idle connections to the peer, e.g. when it is known to be dead
+func (c *RPCClient) Evict(targetNodeAddr string) {
+	c.mutex.Lock()
+	clients := c.idle[targetNodeAddr]
+	delete(c.idle, targetNodeAddr)
+	c.mutex.Unlock()
+	for _, client := range clients {
+		client.Close()
+	}
+}
+
+// Close closes all the idle connections
+func (c *RPCClient) Close() {
+	c.mutex.Lock()
+	idle := c.idle
+	c.idle = make(map[string][]*rpc.Client)
+	c.mutex.Unlock()
+	for _, clients := range idle {
+		for _, client := range clients {
+			client.Close()
+		}
+	}
+}
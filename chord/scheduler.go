@@ -0,0 +1,141 @@
+package chord
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// TaskStats are the run statistics of a maintenance task
+type TaskStats struct {
+	Runs          int
+	Failures      int           //runs that returned an error
+	LastRun       time.Time     //the start of the last run
+	LastDuration  time.Duration //how long the last run took
+	MaxDuration   time.Duration
+	TotalDuration time.Duration
+	LastError     string        //the error of the last failed run
+	Delay         time.Duration //the current delay between two runs, before the jitter
+}
+
+// ScheduledExecutor runs a maintenance task of the node periodically
+// a run starts only after the previous one returned, so a slow task is never run concurrently with itself
+// the delay is randomized by jitter so that the nodes do not run their tasks in lockstep,
+// it grows up to maxDelay while the ring does not change, and falls back to delay after a change
+type ScheduledExecutor struct {
+	Name     string
+	delay    time.Duration //the delay between runs after a membership change
+	maxDelay time.Duration //the delay backs off up to maxDelay while the ring is stable
+	jitter   float64       //the delay is randomized by ±jitter of itself
+
+	quit chan int
+	wake chan struct{} //the ring changed, run sooner
+
+	mutex sync.Mutex
+	stats TaskStats
+}
+
+func NewScheduledExecutor(name string, delay time.Duration, backoff int, jitter float64) *ScheduledExecutor {
+	if backoff < 1 {
+		backoff = 1
+	}
+	return &ScheduledExecutor{
+		Name:     name,
+		delay:    delay,
+		maxDelay: delay * time.Duration(backoff),
+		jitter:   jitter,
+		quit:     make(chan int),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Start runs the task until Stop is called
+// changes returns a counter of the membership changes, it tells whether the ring changed during a run
+func (s *ScheduledExecutor) Start(task func() error, changes func() uint64) {
+	go func() {
+		current := s.delay
+		deadline := time.Now().Add(s.jittered(current))
+		// the timer is replaced after every run, the current one is stopped when the executor quits
+		timer := time.NewTimer(time.Until(deadline))
+		for {
+			select {
+			case <-timer.C:
+			case <-s.wake:
+				// run after the short delay, unless the task is due earlier anyway
+				current = s.delay
+				sooner := time.Now().Add(s.jittered(current))
+				if sooner.Before(deadline) {
+					deadline = sooner
+					timer.Stop()
+					timer = time.NewTimer(time.Until(deadline))
+				}
+				continue
+			case <-s.quit:
+				timer.Stop()
+				return
+			}
+
+			before := changes()
+			start := time.Now()
+			err := task()
+			elapsed := time.Since(start)
+			if changes() != before {
+				current = s.delay
+			} else if current < s.maxDelay {
+				current *= 2
+				if current > s.maxDelay {
+					current = s.maxDelay
+				}
+			}
+			s.record(start, elapsed, err, current)
+
+			deadline = time.Now().Add(s.jittered(current))
+			timer = time.NewTimer(time.Until(deadline))
+		}
+	}()
+}
+
+// Stop waits for the running task to return, then stops the executor
+func (s *ScheduledExecutor) Stop() {
+	s.quit <- 1
+}
+
+// Wake tells the executor that the ring changed, the task is run again after the short delay
+func (s *ScheduledExecutor) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns the run statistics of the task
+func (s *ScheduledExecutor) Stats() TaskStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.stats
+}
+
+func (s *ScheduledExecutor) record(start time.Time, elapsed time.Duration, err error, delay time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stats.Runs++
+	s.stats.LastRun = start
+	s.stats.LastDuration = elapsed
+	s.stats.TotalDuration += elapsed
+	if elapsed > s.stats.MaxDuration {
+		s.stats.MaxDuration = elapsed
+	}
+	if err != nil {
+		s.stats.Failures++
+		s.stats.LastError = err.Error()
+	}
+	s.stats.Delay = delay
+}
+
+// jittered randomizes the delay within [delay*(1-jitter), delay*(1+jitter)]
+func (s *ScheduledExecutor) jittered(delay time.Duration) time.Duration {
+	if s.jitter <= 0 {
+		return delay
+	}
+	return time.Duration(float64(delay) * (1 + s.jitter*(2*rand.Float64()-1)))
+}
@@ -0,0 +1,548 @@
+package chord
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"time"
+)
+
+func (node *Node) stabilize() error {
+	//keep the last known successors and predecessor on disk
+	defer node.saveState()
+
+	//firstly, update successor list
+	//the successor list of node: successor[0] is the next server node that near active node
+	//1-(n-1) are the first (n-1) items of the successor list of successor[0]
+	//if successor[0] is dead, remove it and shift the successor list to the upper
+	var getSuccessorListRPCReply GetSuccessorListRPCReply
+	successor, _ := node.successor()
+	err := node.call(successor, "Node.GetSuccessorListRPC", struct{}{}, &getSuccessorListRPCReply)
+	successorListReply := getSuccessorListRPCReply.SuccessorList
+	successorIdsReply := getSuccessorListRPCReply.SuccessorIds
+	if err != nil {
+		node.suspect(successor)
+	}
+	node.mutex.Lock()
+	successorList := append([]string{}, node.SuccessorsAddr...)
+	if node.SuccessorsAddr[0] != successor {
+		// the successor has been changed meanwhile, e.g. by SetSuccessorListRPC
+	} else if err == nil {
+		for i := 0; i < len(successorListReply)-1 && i+1 < len(node.SuccessorsAddr); i++ {
+			node.SuccessorsAddr[i+1] = successorListReply[i]
+			node.SuccessorsId[i+1] = nil
+			if i < len(successorIdsReply) {
+				node.SuccessorsId[i+1] = successorIdsReply[i]
+			}
+		}
+	} else {
+		log.Println("Failed to get successor list", err)
+		if node.SuccessorsAddr[0] == "" {
+			log.Println("successorList[0] is empty, use itself as successorList[0]")
+			node.SuccessorsAddr[0] = node.Addr
+			node.SuccessorsId[0] = node.Identifier
+		} else {
+			//successorList[0] is dead, remove it and shift the list to the upper
+			for i := 0; i < len(node.SuccessorsAddr); i++ {
+				if i == len(node.SuccessorsAddr)-1 {
+					node.SuccessorsAddr[i] = ""
+					node.SuccessorsId[i] = nil
+				} else {
+					node.SuccessorsAddr[i] = node.SuccessorsAddr[i+1]
+					node.SuccessorsId[i] = node.SuccessorsId[i+1]
+				}
+			}
+			if node.SuccessorsAddr[0] == "" {
+				node.SuccessorsAddr[0] = node.Addr
+				node.SuccessorsId[0] = node.Identifier
+			}
+		}
+	}
+	for i := range successorList {
+		if successorList[i] != node.SuccessorsAddr[i] {
+			node.membershipChanged()
+			break
+		}
+	}
+	successor = node.SuccessorsAddr[0]
+	successorID := node.SuccessorsId[0]
+	node.mutex.Unlock()
+
+	//change the active node's successor to the successor[0]'s predecessor
+	//find the predecessor of the node's successor
+	var getPredecessorRPCReply GetPredecessorRPCReply
+	err = node.call(successor, "Node.GetPredecessorRPC", struct{}{}, &getPredecessorRPCReply)
+	//if the predecessor is not the active node
+	//change the node's successor to the newer predecessor of pre-successor of the active node and notify
+	if err == nil {
+		predecessorAddr := getPredecessorRPCReply.PredecessorAddr
+		predecessorID := getPredecessorRPCReply.PredecessorId
+		if predecessorAddr != "" && predecessorID != nil && successorID != nil && between(node.Identifier, predecessorID, successorID, false) {
+			node.mutex.Lock()
+			if node.SuccessorsAddr[0] == successor && successor != predecessorAddr {
+				node.SuccessorsAddr[0] = predecessorAddr
+				node.SuccessorsId[0] = predecessorID
+				node.membershipChanged()
+			}
+			successor = node.SuccessorsAddr[0]
+			node.mutex.Unlock()
+		}
+
+	}
+	//notify
+	err = node.call(successor, "Node.NotifyRPC", NotifyRPCArgs{Addr: node.Addr, Identifier: node.Identifier}, &NotifyRPCReply{})
+	if err != nil {
+		log.Printf("[stabilize] Notify rpc error: %s\n", err)
+	}
+	// Take over the backup of the files the node is responsible for, e.g. after its predecessor failed
+	node.promoteBackup()
+	// Copy current bucket to the backups of the successors(do not do it if there is one node left)
+	err = node.replicate()
+	if err != nil {
+		return err
+	}
+	if successor == node.Addr {
+		return nil
+	}
+	// Hand over the files that another node is responsible for, e.g. after a restart
+	node.announceOwnership()
+	// Clean the redundant file in successor's backup
+	node.cleanRedundantFile()
+
+	return nil
+}
+
+// replicaTargets returns the first Replicas live successors, which hold the backup of the bucket
+func (node *Node) replicaTargets() []string {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	var targets []string
+	for _, addr := range node.SuccessorsAddr {
+		if len(targets) == node.options.Replicas {
+			break
+		}
+		if addr == "" || addr == node.Addr || node.suspected[addr] || contains(targets, addr) {
+			continue
+		}
+		targets = append(targets, addr)
+	}
+	return targets
+}
+
+// replicate syncs the backups of the new replica targets with the bucket
+// a new target gets the digest of the bucket and the tombstones of the range (predecessor, node], drops the files
+// which are not in the digest, and answers the files it misses, which are the only ones sent
+// the targets that were synced before are kept in sync by antiEntropy, which sends only the ranges that differ
+// the successors which are no longer targets, e.g. because a node joined before them, drop the backup of the range
+func (node *Node) replicate() error {
+	node.mutex.RLock()
+	tombstone := make(map[*big.Int]string, len(node.Tombstone))
+	for k, v := range node.Tombstone {
+		tombstone[k] = v
+	}
+	digest := make([]FileDigest, 0, len(node.Bucket))
+	for k, v := range node.Bucket {
+		digest = append(digest, node.fileDigests(k, v)...)
+	}
+	predecessorId := node.PredecessorId
+	previous := append([]string{}, node.replicas...)
+	node.mutex.RUnlock()
+
+	targets := node.replicaTargets()
+	var synced []string
+	var firstErr error
+	for _, target := range targets {
+		if contains(previous, target) {
+			synced = append(synced, target)
+			continue
+		}
+		args := SyncBackupRPCArgs{Owner: node.Addr, Start: predecessorId, End: node.Identifier, Files: digest, Tombstone: tombstone}
+		err := node.syncReplica(target, args)
+		if err != nil {
+			log.Println("Sync successor's backup error: ", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		synced = append(synced, target)
+	}
+	if predecessorId != nil {
+		for _, addr := range previous {
+			if contains(targets, addr) {
+				continue
+			}
+			args := DeleteSuccessorBackupRPCArgs{Start: predecessorId, End: node.Identifier}
+			err := node.call(addr, "Node.DeleteSuccessorBackupRPC", args, &DeleteSuccessorBackupRPCReply{})
+			if err != nil {
+				log.Printf("[replicate] Failed to release the backup at %s: %s\n", addr, err)
+			}
+		}
+	}
+	node.mutex.Lock()
+	node.replicas = synced
+	node.mutex.Unlock()
+	return firstErr
+}
+
+// syncReplica syncs the backup of the range of args at the replica, and sends the files it misses
+func (node *Node) syncReplica(replica string, args SyncBackupRPCArgs) error {
+	var syncBackupRPCReply SyncBackupRPCReply
+	err := node.call(replica, "Node.SyncBackupRPC", args, &syncBackupRPCReply)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(args.Tombstone))
+	for _, v := range args.Tombstone {
+		names = append(names, v)
+	}
+	node.ackTombstones(replica, names)
+	for _, f := range syncBackupRPCReply.Missing {
+		newFile := FileStructure{}
+		newFile.Id = f.Id
+		newFile.Name = f.Name
+		newFile.Clock = f.Clock
+		err = node.sendFile(replica, newFile, node.siblingPath(f.Name, f.Clock), true, true)
+		if err != nil {
+			log.Println("[syncReplica] Store files to successor error: ", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// tombstoneAck tells since when the node holds a tombstone of its bucket, and which replicas have recorded it
+type tombstoneAck struct {
+	since    time.Time
+	replicas []string
+}
+
+// ackTombstones records that the replica holds the tombstones of the files
+func (node *Node) ackTombstones(replica string, names []string) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	for _, name := range names {
+		ack, ok := node.tombstoneAcks[name]
+		if !ok {
+			continue
+		}
+		if !contains(ack.replicas, replica) {
+			ack.replicas = append(ack.replicas, replica)
+		}
+	}
+}
+
+// compactTombstones drops the tombstones of the bucket that every replica target has recorded,
+// once they are older than TombstoneTTL, a stale copy handed over until then is still refused
+// the replicas drop their backup tombstone with the next repair of the range, see antiEntropy
+func (node *Node) compactTombstones() {
+	targets := node.replicaTargets()
+	node.mutex.Lock()
+	compacted := false
+	for k, v := range node.Tombstone {
+		ack, ok := node.tombstoneAcks[v]
+		if !ok {
+			// the tombstone was restored or promoted from the backup, its age is counted from now
+			node.tombstoneAcks[v] = &tombstoneAck{since: time.Now()}
+			continue
+		}
+		if time.Since(ack.since) < node.options.TombstoneTTL {
+			continue
+		}
+		recorded := true
+		for _, target := range targets {
+			if !contains(ack.replicas, target) {
+				recorded = false
+			}
+		}
+		if recorded {
+			delete(node.Tombstone, k)
+			delete(node.tombstoneAcks, v)
+			compacted = true
+		}
+	}
+	node.mutex.Unlock()
+	if compacted {
+		node.saveState()
+	}
+}
+
+// promoteBackup moves the backup of the files the node is responsible for into the bucket
+// they are the files in (predecessor, node], or all of them if the node is alone in the Chord
+// while the predecessor is unknown, e.g. it just failed, the backup still serves the files, see findFile
+func (node *Node) promoteBackup() {
+	node.mutex.Lock()
+	alone := node.SuccessorsAddr[0] == node.Addr
+	if node.PredecessorId == nil && !alone {
+		node.mutex.Unlock()
+		return
+	}
+	owned := func(id *big.Int) bool {
+		return alone || between(node.PredecessorId, id, node.Identifier, true)
+	}
+	promoted := false
+	for k, v := range node.Backup {
+		if !owned(k) {
+			continue
+		}
+		delete(node.Backup, k)
+		if v != "" && !node.isBackupTombstone(k) && !containsKey(node.Tombstone, k) && !containsKey(node.Bucket, k) {
+			node.Bucket[k] = v
+		}
+		promoted = true
+	}
+	// the deleted files of the predecessor are now deleted files of this node
+	for k, v := range node.BackupTombstone {
+		if !owned(k) {
+			continue
+		}
+		delete(node.BackupTombstone, k)
+		if !containsKey(node.Tombstone, k) {
+			node.Tombstone[k] = v
+		}
+		promoted = true
+	}
+	node.mutex.Unlock()
+	if promoted {
+		node.saveState()
+	}
+}
+
+// announceOwnership hands over the files of the bucket which are not in (predecessor, node]
+// a restarted node may hold files of a range that was taken over while it was down,
+// and a node may hold files of its predecessor that it promoted from its backup
+func (node *Node) announceOwnership() {
+	node.mutex.RLock()
+	predecessorAddr := node.PredecessorAddr
+	predecessorID := node.PredecessorId
+	bucket := node.copyBucket()
+	node.mutex.RUnlock()
+	if predecessorAddr == "" || predecessorID == nil || predecessorAddr == node.Addr || len(bucket) == 0 {
+		return
+	}
+
+	handedOver := false
+	for k, v := range bucket {
+		if between(predecessorID, k, node.Identifier, true) {
+			continue
+		}
+		owner := node.lookup(k)
+		if owner == "" || owner == node.Addr {
+			continue
+		}
+		err := node.sendSiblings(owner, k, v, false, true)
+		if err != nil {
+			log.Println("[announceOwnership] Hand over file error: ", err)
+			continue
+		}
+		node.mutex.Lock()
+		delete(node.Bucket, k)
+		node.mutex.Unlock()
+		handedOver = true
+	}
+	if handedOver {
+		node.saveState()
+	}
+}
+
+func (node *Node) cleanRedundantFile() {
+	// Read all local storage files
+	// the lock keeps storeFile from adding a file while it is checked
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	filePath := node.nodeFolder() + "/chord_storage"
+	files, err := os.ReadDir(filePath)
+	if err != nil {
+		log.Println("[cleanRedundantFile] Read directory error: ", err)
+		return
+	}
+	held := make(map[string]bool)
+	for _, name := range node.Bucket {
+		held[name] = true
+	}
+	for _, name := range node.Backup {
+		held[name] = true
+	}
+	// the versions of the files in the bucket and the backup are kept
+	kept := make(map[string]bool)
+	for name, clocks := range node.Siblings {
+		if !held[name] {
+			delete(node.Siblings, name)
+			continue
+		}
+		for _, clock := range clocks {
+			kept[siblingFile(name, clock)] = true
+		}
+	}
+	for _, file := range files {
+		fileName := file.Name()
+		if !kept[fileName] {
+			// The version is not in backup and bucket, delete it
+			path := filePath + "/" + fileName
+			err = os.Remove(path)
+			if err != nil {
+				log.Printf("[cleanRedundantFile] Cannot remove the file[%s]: ", path)
+				return
+			}
+		}
+	}
+}
+
+// containsKey tells whether the files hold the id, the caller holds the lock
+func containsKey(files map[*big.Int]string, id *big.Int) bool {
+	for k, _ := range files {
+		if k.Cmp(id) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(addrs []string, addr string) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// the caller holds the lock
+func (node *Node) isBackupTombstone(fileId *big.Int) bool {
+	for k, _ := range node.BackupTombstone {
+		if k.Cmp(fileId) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// input the index of the finger, [1,M]
+// return the start of the interval, (n+2^(i-1)) mod 2^M
+func (node *Node) FingerStart(nodeId int) *big.Int {
+	id := node.Identifier
+	id = new(big.Int).Add(id, new(big.Int).Exp(big.NewInt(2), big.NewInt(int64(nodeId)-1), nil))
+	return new(big.Int).Mod(id, node.HashMod)
+}
+
+// FixFingers updates finger table
+// the fingers pointing to suspected nodes are replaced first, then the next finger in turn is refreshed
+func (node *Node) FixFingers() error {
+	node.mutex.Lock()
+	var fingers []int
+	for i := 1; i < node.M+1; i++ {
+		if node.suspected[node.FingerTable[i].Addr] {
+			fingers = append(fingers, i)
+		}
+	}
+	node.nextFinger += 1
+	if node.nextFinger > node.M {
+		node.nextFinger = 1
+	}
+	fingers = append(fingers, node.nextFinger)
+	node.mutex.Unlock()
+
+	for _, nextFinger := range fingers {
+		node.fixFinger(nextFinger)
+	}
+	node.forgetSuspects()
+
+	// optimization,
+	//for {
+	//	node.nextFinger += 1
+	//	if node.nextFinger > node.M {
+	//		node.nextFinger = 0
+	//	}
+	//	key = new(big.Int).Add(node.Identifier, new(big.Int).Exp(big.NewInt(2), big.NewInt(int64(node.nextFinger)-1), nil))
+	//	key.Mod(key, node.HashMod)
+	//
+	//	next = Lookup(key, node.Addr)
+	//	successorId := StrHash(next)
+	//	successorId.Mod(successorId, node.HashMod)
+	//	if between(node.Identifier, key, successorId, false) {
+	//		if node.FingerTable[node.nextFinger].Addr != next {
+	//			node.FingerTable[node.nextFinger].Addr = next
+	//			node.FingerTable[node.nextFinger].Identifier = key.Bytes()
+	//		}
+	//	} else {
+	//		node.nextFinger -= 1
+	//		return nil
+	//	}
+	//}
+	return nil
+}
+
+// fixFinger sets the finger to the successor of its start
+func (node *Node) fixFinger(nextFinger int) {
+	// n + 2^next-1, this key is a file id
+	key := node.FingerStart(nextFinger)
+
+	// find the successor of the key
+	trace := node.lookupTrace(key)
+	next := trace.Successor
+	if next == "" || trace.SuccessorId == nil {
+		return
+	}
+	if node.isSuspected(next) {
+		// the lookup still resolves to the suspected node, it is no longer suspected if it answers
+		node.call(next, "Node.GetAddrRPC", "", &GetAddrRPCReply{})
+	}
+
+	node.mutex.Lock()
+	if node.FingerTable[nextFinger].Addr != next {
+		node.membershipChanged()
+	}
+	node.FingerTable[nextFinger].Addr = next
+	node.FingerTable[nextFinger].NodeId = trace.SuccessorId
+	node.FingerTable[nextFinger].Identifier = key.Bytes()
+	node.mutex.Unlock()
+}
+
+// forgetSuspects drops the suspected nodes that are no longer in the finger table or the successor list
+func (node *Node) forgetSuspects() {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	known := make(map[string]bool)
+	for i := 1; i < len(node.FingerTable); i++ {
+		known[node.FingerTable[i].Addr] = true
+	}
+	for _, addr := range node.SuccessorsAddr {
+		known[addr] = true
+	}
+	for addr := range node.suspected {
+		if !known[addr] {
+			delete(node.suspected, addr)
+		}
+	}
+}
+
+// check whether predecessor has failed
+func (node *Node) checkPredecessor() error {
+	pred, _ := node.predecessor()
+	if pred != "" {
+		var getAddrRPCReply GetAddrRPCReply
+		err := node.call(pred, "Node.GetAddrRPC", "", &getAddrRPCReply)
+		if err != nil {
+			fmt.Printf("Predecessor %s has failed\n", pred)
+			node.transport.Evict(pred)
+			node.suspect(pred)
+			node.mutex.Lock()
+			if node.PredecessorAddr != pred {
+				// a new predecessor has notified the node meanwhile
+				node.mutex.Unlock()
+				return nil
+			}
+			node.PredecessorAddr = ""
+			node.PredecessorId = nil
+			node.membershipChanged()
+			node.mutex.Unlock()
+			// the backup of the files of the predecessor is promoted once the new predecessor is known,
+			// the backup may hold the files of further predecessors which are still alive
+			node.promoteBackup()
+			node.saveState()
+
+		}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package chord
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+)
+
+// nodeState is the part of the node that is kept in the node folder, so that a restarted node
+// gets back the files it held and knows where to rejoin the Chord
+type nodeState struct {
+	M int
+
+	Bucket          map[*big.Int]string
+	Backup          map[*big.Int]string
+	Tombstone       map[*big.Int]string
+	BackupTombstone map[*big.Int]string
+	Siblings        map[string][]VectorClock
+	Writes          uint64
+
+	PredecessorAddr string
+	PredecessorId   *big.Int
+	SuccessorsAddr  []string
+	SuccessorsId    []*big.Int
+}
+
+func (node *Node) statePath() string {
+	return node.nodeFolder() + "/state.json"
+}
+
+// saveState writes the state of the node to disk, the old state is replaced atomically
+// the caller must not hold the lock
+func (node *Node) saveState() {
+	node.mutex.RLock()
+	state := nodeState{
+		M:               node.M,
+		Bucket:          node.Bucket,
+		Backup:          node.Backup,
+		Tombstone:       node.Tombstone,
+		BackupTombstone: node.BackupTombstone,
+		Siblings:        node.Siblings,
+		Writes:          node.writes,
+		PredecessorAddr: node.PredecessorAddr,
+		PredecessorId:   node.PredecessorId,
+		SuccessorsAddr:  node.SuccessorsAddr,
+		SuccessorsId:    node.SuccessorsId,
+	}
+	content, err := json.Marshal(state)
+	node.mutex.RUnlock()
+	if err != nil {
+		log.Println("[saveState] Failed to encode the node state: ", err)
+		return
+	}
+	node.saveMutex.Lock()
+	defer node.saveMutex.Unlock()
+	path := node.statePath()
+	err = os.WriteFile(path+".tmp", content, 0644)
+	if err != nil {
+		log.Println("[saveState] Failed to write the node state: ", err)
+		return
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		log.Println("[saveState] Failed to replace the node state: ", err)
+	}
+}
+
+// loadState restores the state saved before the node was stopped
+// files whose content is missing from the chord storage are dropped
+func (node *Node) loadState() {
+	content, err := os.ReadFile(node.statePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("[loadState] Failed to read the node state: ", err)
+		}
+		return
+	}
+	var state nodeState
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		log.Println("[loadState] Failed to decode the node state: ", err)
+		return
+	}
+	if state.M != node.M {
+		log.Printf("[loadState] The node state is for m=%d instead of m=%d, ignore it\n", state.M, node.M)
+		return
+	}
+
+	for k, v := range state.Bucket {
+		if node.restoreSiblings(v, state.Siblings[v]) {
+			node.Bucket[k] = v
+		}
+	}
+	for k, v := range state.Backup {
+		if node.restoreSiblings(v, state.Siblings[v]) {
+			node.Backup[k] = v
+		}
+	}
+	for k, v := range state.Tombstone {
+		node.Tombstone[k] = v
+	}
+	for k, v := range state.BackupTombstone {
+		node.BackupTombstone[k] = v
+	}
+	node.writes = state.Writes
+	node.PredecessorAddr = state.PredecessorAddr
+	node.PredecessorId = state.PredecessorId
+	for i := 0; i < len(node.SuccessorsAddr) && i < len(state.SuccessorsAddr); i++ {
+		node.SuccessorsAddr[i] = state.SuccessorsAddr[i]
+		// the identifier of a node can not be derived from its address, a successor saved without it
+		// is only used to rejoin the Chord
+		if i < len(state.SuccessorsId) {
+			node.SuccessorsId[i] = state.SuccessorsId[i]
+		}
+	}
+	log.Printf("[loadState] Restored %d files in bucket and %d files in backup\n", len(node.Bucket), len(node.Backup))
+}
+
+// restoreSiblings keeps the versions of the file whose content is in the chord storage, false if there is none
+// a file stored before the files had versions becomes a version that every write descends
+func (node *Node) restoreSiblings(fileName string, clocks []VectorClock) bool {
+	if len(clocks) == 0 {
+		unversioned := node.nodeFolder() + "/chord_storage/" + fileName
+		if os.Rename(unversioned, node.siblingPath(fileName, VectorClock{})) == nil {
+			clocks = []VectorClock{{}}
+		}
+	}
+	var kept []VectorClock
+	for _, clock := range clocks {
+		if _, err := os.Stat(node.siblingPath(fileName, clock)); err == nil {
+			kept = append(kept, clock)
+		}
+	}
+	if len(kept) == 0 {
+		return false
+	}
+	node.Siblings[fileName] = kept
+	return true
+}
+
+// hasKnownNodes tells whether the restored state knows other nodes of the Chord
+func (node *Node) hasKnownNodes() bool {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	if node.PredecessorAddr != "" && node.PredecessorAddr != node.Addr {
+		return true
+	}
+	for _, addr := range node.SuccessorsAddr {
+		if addr != "" && addr != node.Addr {
+			return true
+		}
+	}
+	return false
+}
+
+// rejoinChord joins the Chord again through the successors and predecessor known before the restart
+func (node *Node) rejoinChord() error {
+	node.mutex.RLock()
+	knownAddrs := append([]string{}, node.SuccessorsAddr...)
+	knownAddrs = append(knownAddrs, node.PredecessorAddr)
+	node.mutex.RUnlock()
+	var seeds []string
+	for _, addr := range knownAddrs {
+		if addr != "" && addr != node.Addr {
+			seeds = append(seeds, addr)
+		}
+	}
+	if len(seeds) == 0 {
+		return errors.New("no node is known to rejoin the Chord")
+	}
+	// the files that are no longer ours are handed over by announceOwnership once the ring is stable
+	return node.joinSeeds(seeds, 1)
+}
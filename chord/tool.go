@@ -0,0 +1,269 @@
+package chord
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+)
+
+// hash file name to m-digits number
+func StrHash(elt string) *big.Int {
+	hasher := sha1.New()
+	hasher.Write([]byte(elt))
+	return new(big.Int).SetBytes(hasher.Sum(nil))
+}
+
+func between(start, elt, end *big.Int, inclusive bool) bool {
+	if end.Cmp(start) > 0 { // start < end
+		return (start.Cmp(elt) < 0 && elt.Cmp(end) < 0) || (inclusive && elt.Cmp(end) == 0)
+	} else {
+		return start.Cmp(elt) < 0 || elt.Cmp(end) < 0 || (inclusive && elt.Cmp(end) == 0)
+	}
+}
+
+// localAddress returns an address of a network interface of the host, for a node bound to all interfaces
+// an IPv4 address is preferred, the loopback address is returned if the host has no other one
+func localAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Println("[localAddress] Failed to list the interface addresses: ", err)
+		return "127.0.0.1"
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+		if found == nil {
+			found = ipNet.IP
+		}
+	}
+	if found == nil {
+		return "127.0.0.1"
+	}
+	return found.String()
+}
+
+func (node *Node) genRSAKey(bits int) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		log.Println("[genRSAKey] Failed to generate private key for node ", node.Name, "N"+node.Identifier.String())
+	}
+	node.PrivateKey = privateKey
+	node.PublicKey = &privateKey.PublicKey
+
+	//store private key in the node folder
+	privateKeyDER := x509.MarshalPKCS1PrivateKey(privateKey)
+	block := pem.Block{Type: "N" + node.Identifier.String() + "-private Key",
+		Headers: nil,
+		Bytes:   privateKeyDER}
+	nodeFolder := node.nodeFolder()
+	privateKeyFile, err := os.Create(nodeFolder + "/private.pem")
+	if err != nil {
+		log.Println("[genRSAKey] Failed to create private key file for node ", node.Name, "N"+node.Identifier.String())
+	}
+	defer privateKeyFile.Close()
+	err = pem.Encode(privateKeyFile, &block)
+	if err != nil {
+		log.Println("[genRSAKey] Failed to write private key into file")
+	}
+
+	//store public kay in the node folder
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(node.PublicKey)
+	if err != nil {
+		log.Println("[genRSAKey] Failed to get DER format of public key for node ", node.Name)
+	}
+	block = pem.Block{
+		Type:    "N" + node.Identifier.String() + "-public Key",
+		Headers: nil,
+		Bytes:   publicKeyDER,
+	}
+	publicKeyFile, err := os.Create(nodeFolder + "/public.pem")
+	if err != nil {
+		log.Println("[genRSAKey] Failed to create public key file for node ", node.Name)
+	}
+	defer publicKeyFile.Close()
+	err = pem.Encode(publicKeyFile, &block)
+	if err != nil {
+		log.Println("[genRSAKey] Failed to write public key into file")
+	}
+}
+
+// loadRSAKey reads the key pair stored in the node folder by genRSAKey
+func (node *Node) loadRSAKey() error {
+	nodeFolder := node.nodeFolder()
+	privateKeyPEM, err := os.ReadFile(nodeFolder + "/private.pem")
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return errors.New("no PEM block in " + nodeFolder + "/private.pem")
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	node.PrivateKey = privateKey
+	node.PublicKey = &privateKey.PublicKey
+	return nil
+}
+
+// files are envelope-encrypted: every transfer uses a random AES-256 data key, which is wrapped with the
+// RSA public key of the node who decrypts the file, and every chunk of the file is sealed with AES-GCM
+const dataKeyLen = 32
+
+func newDataKey() ([]byte, error) {
+	dataKey := make([]byte, dataKeyLen)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return dataKey, nil
+}
+
+// wrapDataKey encrypts the data key with RSA-OAEP for the owner of the public key
+func wrapDataKey(dataKey []byte, publicKey *rsa.PublicKey) ([]byte, error) {
+	if publicKey == nil {
+		return nil, errors.New("the public key of the receiver is empty")
+	}
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, dataKey, nil)
+}
+
+// unwrapDataKey decrypts a data key that was wrapped with the public key of the node
+func (node *Node) unwrapDataKey(encryptedKey []byte) ([]byte, error) {
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, node.PrivateKey, encryptedKey, nil)
+	if err != nil {
+		return nil, errors.New("failed to unwrap the data key: " + err.Error())
+	}
+	return dataKey, nil
+}
+
+// newDataKeyFor generates a data key and wraps it with the public key of the node at addr
+// both are nil if encryption is disabled
+func (node *Node) newDataKeyFor(addr string) ([]byte, []byte, error) {
+	if !node.EncryptFlag {
+		return nil, nil, nil
+	}
+	var getPublicKeyRPCReply GetPublicKeyRPCReply
+	err := node.call(addr, "Node.GetPublicKeyRPC", "", &getPublicKeyRPCReply)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataKey, err := newDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	encryptedKey, err := wrapDataKey(dataKey, getPublicKeyRPCReply.Public_Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, encryptedKey, nil
+}
+
+// sealChunk encrypts one chunk of the file with AES-GCM
+// the file name and the offset of the chunk are authenticated as well, so a chunk can not be moved to another place
+func sealChunk(dataKey []byte, name string, offset int64, data []byte) ([]byte, []byte, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, gcm.Seal(nil, nonce, data, chunkAdditionalData(name, offset)), nil
+}
+
+// openChunk decrypts one chunk of the file, an error is returned if the chunk has been tampered with
+func openChunk(dataKey []byte, name string, offset int64, nonce []byte, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("the nonce of the chunk is invalid")
+	}
+	data, err := gcm.Open(nil, nonce, sealed, chunkAdditionalData(name, offset))
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate the chunk of %s at offset %d: %s", name, offset, err)
+	}
+	return data, nil
+}
+
+func chunkAdditionalData(name string, offset int64) []byte {
+	return []byte(fmt.Sprintf("%s:%d", name, offset))
+}
+
+func newGCM(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadNATFile reads a static NAT mapping, every line maps a private address to the public one, e.g.
+//
+//	# private         public
+//	172.31.21.112     54.145.27.145
+//	10.0.0.5:8080     203.0.113.7:18080
+//
+// an address is a host or a host:port, a mapping without port keeps the port unchanged
+func LoadNATFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mapping := make(map[string]string)
+	for i, line := range strings.Split(string(content), "\n") {
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a private and a public address", path, i+1)
+		}
+		mapping[fields[0]] = fields[1]
+	}
+	return mapping, nil
+}
+
+// natAddress returns the public address of the host:port addr in the NAT mapping
+// the host:port is looked up first, then the host alone; addr is returned if neither is mapped
+func natAddress(mapping map[string]string, addr string) string {
+	if public, ok := mapping[addr]; ok {
+		return public
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if public, ok := mapping[host]; ok {
+		if _, _, err := net.SplitHostPort(public); err == nil {
+			return public
+		}
+		return net.JoinHostPort(public, port)
+	}
+	return addr
+}
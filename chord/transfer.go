@@ -0,0 +1,583 @@
+package chord
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// files are transferred in chunks, so that a file is never held in memory as a whole
+// every chunk carries its offset and a SHA-256 checksum of the transferred bytes,
+// and an interrupted transfer is resumed from the last offset acknowledged by the receiver
+const chunkSize = 1 << 20 // 1MB
+
+// the number of times a chunk is resent before the transfer is given up
+const maxChunkRetries = 3
+
+// the wait before the first resend of a chunk, doubled after every failed resend
+const chunkRetryDelay = 100 * time.Millisecond
+
+// a transfer that got no chunk for transferIdle is taken over by a new send of the same file,
+// a more recent one is still being sent and the new send is rejected
+const transferIdle = 2 * DefaultCallTimeout
+
+// transfer is a file being received in chunks
+// the chunks of a transfer are written one at a time, without holding the lock of the node
+type transfer struct {
+	mutex   sync.Mutex
+	File    FileStructure
+	Backup  bool
+	Handoff bool
+	dataKey []byte
+	Offset  int64 // the content before Offset has been written into the transfer file
+
+	lastActive time.Time //the time of the last chunk, see sweepTransfers
+	abandoned  bool      //the transfer was taken over or swept, its chunks are refused
+}
+
+type BeginTransferRPCArgs struct {
+	File    FileStructure
+	Backup  bool   // store the file in the Backup instead of the Bucket
+	Handoff bool   // the file is copied between the nodes, not written by a client, a copy the receiver already holds is kept
+	Sender  string // the address of the sender, part of the transfer id
+}
+
+type BeginTransferRPCReply struct {
+	TransferId string
+	Offset     int64 // the offset to resume the transfer from
+	Skip       bool  // the receiver does not need the file, nothing to send
+}
+
+type StoreChunkRPCArgs struct {
+	TransferId string
+	Offset     int64
+	Data       []byte
+	Nonce      []byte // the AES-GCM nonce of the chunk, empty if the file is not encrypted
+	Checksum   []byte // SHA-256 of Data
+}
+
+type StoreChunkRPCReply struct {
+	Accepted bool
+	Offset   int64 // the next offset expected by the receiver
+}
+
+type CommitTransferRPCReply struct {
+	Success bool
+}
+
+type FetchChunkRPCArgs struct {
+	FileName     string
+	Clock        VectorClock // the version of the file
+	Offset       int64
+	EncryptedKey []byte // the data key chosen by the requester, wrapped with the public key of the sender
+}
+
+type FetchChunkRPCReply struct {
+	Data     []byte
+	Nonce    []byte
+	Checksum []byte
+}
+
+// sendFile streams the file at filePath to the node at addr, chunk by chunk
+// the file is stored in the Bucket of the receiver, or in its Backup if backUp is true
+// handoff tells the receiver that the file is copied between the nodes, e.g. when keys are moved or a backup is synced,
+// otherwise the file is a write of a client
+func (node *Node) sendFile(addr string, f FileStructure, filePath string, backUp bool, handoff bool) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		log.Println("[sendFile] File cannot be opened: ", err)
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	f.Size = info.Size()
+
+	//encrypt the file
+	dataKey, encryptedKey, err := node.newDataKeyFor(addr)
+	if err != nil {
+		log.Println("[sendFile] Failed to get the data key: ", err)
+		return err
+	}
+	f.EncryptedKey = encryptedKey
+
+	beginReply := BeginTransferRPCReply{}
+	err = node.call(addr, "Node.BeginTransferRPC", BeginTransferRPCArgs{File: f, Backup: backUp, Handoff: handoff, Sender: node.Addr}, &beginReply)
+	if err != nil {
+		return err
+	}
+	if beginReply.Skip {
+		return nil
+	}
+
+	buf := make([]byte, chunkSize)
+	offset := beginReply.Offset
+	retries := 0
+	for offset < f.Size {
+		n, err := file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return errors.New("the file " + f.Name + " is shorter than its size")
+		}
+		args := StoreChunkRPCArgs{TransferId: beginReply.TransferId, Offset: offset, Data: buf[:n]}
+		if dataKey != nil {
+			args.Nonce, args.Data, err = sealChunk(dataKey, f.Name, offset, args.Data)
+			if err != nil {
+				return err
+			}
+		}
+		checksum := sha256.Sum256(args.Data)
+		args.Checksum = checksum[:]
+
+		chunkReply := StoreChunkRPCReply{}
+		err = node.call(addr, "Node.StoreChunkRPC", args, &chunkReply)
+		if err != nil {
+			// the receiver keeps what it has got, the transfer can be resumed later
+			retries++
+			if retries > maxChunkRetries {
+				return fmt.Errorf("failed to send the chunk of %s at offset %d: %s", f.Name, offset, err)
+			}
+			time.Sleep(chunkRetryDelay << (retries - 1))
+			continue
+		}
+		retries = 0
+		offset = chunkReply.Offset
+	}
+
+	commitReply := CommitTransferRPCReply{}
+	return node.call(addr, "Node.CommitTransferRPC", beginReply.TransferId, &commitReply)
+}
+
+// sendSiblings sends every version of the file to the node at addr, see sendFile
+func (node *Node) sendSiblings(addr string, id *big.Int, fileName string, backUp bool, handoff bool) error {
+	for _, clock := range node.fileSiblings(fileName) {
+		f := FileStructure{Id: id, Name: fileName, Clock: clock}
+		err := node.sendFile(addr, f, node.siblingPath(fileName, clock), backUp, handoff)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transferId identifies the transfer of a certain version of a file from a sender
+// the same file sent again by the same sender resumes the transfer
+func transferId(sender string, f FileStructure, backUp bool) string {
+	hasher := sha1.New()
+	hasher.Write([]byte(sender + "|" + f.Name + "|" + f.Clock.String() + "|" + strconv.FormatInt(f.Size, 10) + "|" + strconv.FormatBool(backUp)))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func (node *Node) transferPath(transferId string) string {
+	return node.nodeFolder() + "/transfer/" + transferId
+}
+
+func (node *Node) BeginTransferRPC(args BeginTransferRPCArgs, reply *BeginTransferRPCReply) error {
+	f := args.File
+	err := node.validTransfer(f)
+	if err != nil {
+		log.Println("[BeginTransferRPC] ", err)
+		return err
+	}
+	f.Id.Mod(f.Id, node.HashMod)
+
+	skip, err := node.needlessTransfer(f, args.Backup, args.Handoff)
+	if err != nil {
+		return err
+	}
+	if skip {
+		reply.Skip = true
+		return nil
+	}
+
+	t := &transfer{File: f, Backup: args.Backup, Handoff: args.Handoff, lastActive: time.Now()}
+	if node.EncryptFlag {
+		if len(f.EncryptedKey) == 0 {
+			return errors.New("the file " + f.Name + " is not encrypted")
+		}
+		dataKey, err := node.unwrapDataKey(f.EncryptedKey)
+		if err != nil {
+			log.Println("[BeginTransferRPC] Failed to decrypt the data key ", err)
+			return err
+		}
+		t.dataKey = dataKey
+	}
+
+	id := transferId(args.Sender, f, args.Backup)
+	path := node.transferPath(id)
+	err = os.MkdirAll(node.nodeFolder()+"/transfer", os.ModePerm)
+	if err != nil {
+		log.Println("[BeginTransferRPC] Create transfer folder error: ", err)
+		return err
+	}
+
+	// the transfer file is only looked at under the lock, so that sweepTransfers does not remove it meanwhile
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if previous, ok := node.transfers[id]; ok {
+		previous.mutex.Lock()
+		idle := time.Since(previous.lastActive)
+		if idle < transferIdle {
+			previous.mutex.Unlock()
+			return errors.New("the transfer of " + f.Name + " is in progress: " + id)
+		}
+		// the sender gave up, its chunks are refused from now on and the new send resumes the transfer
+		previous.abandoned = true
+		previous.mutex.Unlock()
+	}
+	// resume from the content received before
+	if info, err := os.Stat(path); err == nil && info.Size() <= f.Size {
+		t.Offset = info.Size()
+	} else {
+		os.Remove(path)
+	}
+	node.transfers[id] = t
+
+	reply.TransferId = id
+	reply.Offset = t.Offset
+	return nil
+}
+
+// validTransfer checks the file announced by BeginTransferRPC before anything is written for it
+// the id must be the hash of the name, and the name must not leave the storage folder
+func (node *Node) validTransfer(f FileStructure) error {
+	if f.Name == "" || f.Name == "." || f.Name == ".." || strings.ContainsAny(f.Name, "/\\") {
+		return errors.New("invalid file name: " + strconv.Quote(f.Name))
+	}
+	if f.Id == nil {
+		return errors.New("the file " + f.Name + " has no id")
+	}
+	id := StrHash(f.Name)
+	id.Mod(id, node.HashMod)
+	if new(big.Int).Mod(f.Id, node.HashMod).Cmp(id) != 0 {
+		return errors.New("the id of the file " + f.Name + " is not the hash of its name")
+	}
+	if f.Size < 0 {
+		return fmt.Errorf("invalid size of the file %s: %d", f.Name, f.Size)
+	}
+	return nil
+}
+
+// needlessTransfer tells whether the receiver already holds the file, or must not store it
+// a write of a client is stored at the owner and at the backups alike, unless a newer version is there
+func (node *Node) needlessTransfer(f FileStructure, backUp bool, handoff bool) (bool, error) {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	held := containsKey(node.Bucket, f.Id) || (backUp && containsKey(node.Backup, f.Id))
+	if !handoff {
+		if held && hasSibling(node.Siblings[f.Name], f.Clock) {
+			log.Println("A newer version of this file already exists in Bucket")
+			return false, errors.New("a newer version of this file already exists in Bucket")
+		}
+		return false, nil
+	}
+	if backUp {
+		// the predecessor deleted the file while it was being copied, do not resurrect it
+		if node.isBackupTombstone(f.Id) {
+			return true, nil
+		}
+		// the backup holds this version, or one that descends it
+		if containsKey(node.Backup, f.Id) && hasSibling(node.Siblings[f.Name], f.Clock) {
+			return true, nil
+		}
+		if containsKey(node.Bucket, f.Id) {
+			return true, nil
+		}
+	} else {
+		// the file was deleted, a node holding a stale copy must not hand it back
+		if containsKey(node.Tombstone, f.Id) {
+			return true, nil
+		}
+		if containsKey(node.Bucket, f.Id) && hasSibling(node.Siblings[f.Name], f.Clock) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (node *Node) StoreChunkRPC(args StoreChunkRPCArgs, reply *StoreChunkRPCReply) error {
+	node.mutex.RLock()
+	t, ok := node.transfers[args.TransferId]
+	node.mutex.RUnlock()
+	if !ok {
+		return errors.New("unknown transfer: " + args.TransferId)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.abandoned {
+		return errors.New("abandoned transfer: " + args.TransferId)
+	}
+	t.lastActive = time.Now()
+
+	reply.Offset = t.Offset
+	if args.Offset != t.Offset {
+		// the chunk is out of order, the sender continues from reply.Offset
+		reply.Accepted = false
+		return nil
+	}
+	checksum := sha256.Sum256(args.Data)
+	if !bytes.Equal(checksum[:], args.Checksum) {
+		return fmt.Errorf("checksum mismatch of the chunk of %s at offset %d", t.File.Name, args.Offset)
+	}
+
+	//decrypt the chunk, a chunk that fails authentication is never stored
+	data := args.Data
+	if t.dataKey != nil {
+		var err error
+		data, err = openChunk(t.dataKey, t.File.Name, args.Offset, args.Nonce, args.Data)
+		if err != nil {
+			log.Println("[StoreChunkRPC] Failed to decrypt the chunk ", err)
+			return err
+		}
+	}
+	if args.Offset+int64(len(data)) > t.File.Size {
+		return fmt.Errorf("the chunk of %s at offset %d exceeds the file size", t.File.Name, args.Offset)
+	}
+
+	file, err := os.OpenFile(node.transferPath(args.TransferId), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		log.Println("[StoreChunkRPC] Open file error: ", err)
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteAt(data, args.Offset)
+	if err != nil {
+		log.Println("[StoreChunkRPC] Write file error: ", err)
+		return err
+	}
+
+	t.Offset += int64(len(data))
+	reply.Accepted = true
+	reply.Offset = t.Offset
+	return nil
+}
+
+func (node *Node) CommitTransferRPC(transferId string, reply *CommitTransferRPCReply) error {
+	node.mutex.RLock()
+	t, ok := node.transfers[transferId]
+	node.mutex.RUnlock()
+	if !ok {
+		return errors.New("unknown transfer: " + transferId)
+	}
+	t.mutex.Lock()
+	offset := t.Offset
+	abandoned := t.abandoned
+	t.mutex.Unlock()
+	if abandoned {
+		return errors.New("abandoned transfer: " + transferId)
+	}
+	if offset != t.File.Size {
+		return fmt.Errorf("the transfer of %s is incomplete: %d of %d bytes", t.File.Name, offset, t.File.Size)
+	}
+	node.mutex.Lock()
+	current, ok := node.transfers[transferId]
+	ok = ok && current == t
+	if ok {
+		delete(node.transfers, transferId)
+	}
+	node.mutex.Unlock()
+	if !ok {
+		// the transfer has been committed by another call
+		return errors.New("unknown transfer: " + transferId)
+	}
+
+	path := node.transferPath(transferId)
+	if t.File.Size == 0 {
+		// no chunk has been sent for an empty file
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+	err := node.storeFile(t.File, t.Backup, t.Handoff, path)
+	reply.Success = err == nil
+	if err != nil {
+		// the error is reported back to the sender
+		log.Println("File storage error!", err)
+		os.Remove(path)
+		return errors.New("File storage error! " + err.Error())
+	}
+	if !t.Backup && !t.Handoff {
+		log.Println("File storage success!")
+	}
+	return nil
+}
+
+// sweepTransfers removes the transfers that got no chunk for TransferTTL, with their partial files,
+// the partial files left in the transfer folder by a previous run of the node,
+// and the downloads and the spooled writes that were left behind for TransferTTL, see fetchFile and spoolContent
+func (node *Node) sweepTransfers() error {
+	ttl := node.options.TransferTTL
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	for id, t := range node.transfers {
+		t.mutex.Lock()
+		stale := time.Since(t.lastActive) > ttl
+		if stale {
+			t.abandoned = true
+		}
+		t.mutex.Unlock()
+		if stale {
+			log.Printf("[sweepTransfers] The transfer of %s is abandoned\n", t.File.Name)
+			delete(node.transfers, id)
+			os.Remove(node.transferPath(id))
+		}
+	}
+
+	for _, folder := range []string{"/transfer", "/fetch", "/outgoing"} {
+		entries, err := os.ReadDir(node.nodeFolder() + folder)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			if _, ok := node.transfers[entry.Name()]; ok && folder == "/transfer" {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) <= ttl {
+				continue
+			}
+			os.Remove(node.nodeFolder() + folder + "/" + entry.Name())
+		}
+	}
+	return nil
+}
+
+// fetchFile download the version f of the file from the node at addr into the fetch folder, and returns its path
+// chunk by chunk, a partial download is kept, and resumed by the next fetch of the same version, even from another node
+func (node *Node) fetchFile(addr string, f FileStructure) (string, error) {
+	fileName := f.Name
+
+	// the data key is chosen by the requester and wrapped for the sender, which seals every chunk with it
+	dataKey, encryptedKey, err := node.newDataKeyFor(addr)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(node.nodeFolder()+"/fetch", os.ModePerm)
+	if err != nil {
+		log.Println("[fetchFile] Create fetch folder error: ", err)
+		return "", err
+	}
+	// the part of every version is kept apart, a download is only resumed with the same version
+	partPath := node.nodeFolder() + "/fetch/" + siblingFile(fileName, f.Clock) + ".part"
+	file, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		log.Println("[fetchFile] Create file error: ", err)
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size()
+	if offset > f.Size {
+		offset = 0
+		file.Truncate(0)
+	}
+
+	retries := 0
+	for offset < f.Size {
+		args := FetchChunkRPCArgs{FileName: fileName, Clock: f.Clock, Offset: offset, EncryptedKey: encryptedKey}
+		chunkReply := FetchChunkRPCReply{}
+		err = node.call(addr, "Node.FetchChunkRPC", args, &chunkReply)
+		if err == nil {
+			checksum := sha256.Sum256(chunkReply.Data)
+			if !bytes.Equal(checksum[:], chunkReply.Checksum) {
+				err = fmt.Errorf("checksum mismatch of the chunk of %s at offset %d", fileName, offset)
+			}
+		}
+		data := chunkReply.Data
+		if err == nil && dataKey != nil {
+			data, err = openChunk(dataKey, fileName, offset, chunkReply.Nonce, chunkReply.Data)
+		}
+		if err == nil && len(data) == 0 {
+			err = fmt.Errorf("empty chunk of %s at offset %d", fileName, offset)
+		}
+		if err != nil {
+			retries++
+			if retries > maxChunkRetries {
+				return "", err
+			}
+			time.Sleep(chunkRetryDelay << (retries - 1))
+			continue
+		}
+		retries = 0
+		_, err = file.WriteAt(data, offset)
+		if err != nil {
+			log.Println("[fetchFile] Write file error: ", err)
+			return "", err
+		}
+		offset += int64(len(data))
+	}
+	file.Truncate(f.Size)
+	return partPath, nil
+}
+
+func (node *Node) FetchChunkRPC(args FetchChunkRPCArgs, reply *FetchChunkRPCReply) error {
+	siblings, _, _ := node.findFile(args.FileName)
+	var f FileStructure
+	found := false
+	for _, sibling := range siblings {
+		if sibling.Clock.Equal(args.Clock) {
+			f = sibling
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("the version " + args.Clock.String() + " of " + args.FileName + " is not stored at node: " + node.Addr)
+	}
+	if args.Offset < 0 || args.Offset >= f.Size {
+		return fmt.Errorf("the offset %d of %s is out of range", args.Offset, args.FileName)
+	}
+
+	file, err := os.Open(node.siblingPath(args.FileName, f.Clock))
+	if err != nil {
+		log.Println("[FetchChunkRPC] Open file error: ", err)
+		return err
+	}
+	defer file.Close()
+	size := f.Size - args.Offset
+	if size > chunkSize {
+		size = chunkSize
+	}
+	data := make([]byte, size)
+	n, err := file.ReadAt(data, args.Offset)
+	if err != nil && err != io.EOF {
+		log.Println("[FetchChunkRPC] Read file error: ", err)
+		return err
+	}
+	reply.Data = data[:n]
+
+	//encrypt the chunk with the data key of the requester
+	if len(args.EncryptedKey) != 0 {
+		dataKey, err := node.unwrapDataKey(args.EncryptedKey)
+		if err != nil {
+			return err
+		}
+		reply.Nonce, reply.Data, err = sealChunk(dataKey, args.FileName, args.Offset, reply.Data)
+		if err != nil {
+			return err
+		}
+	}
+	checksum := sha256.Sum256(reply.Data)
+	reply.Checksum = checksum[:]
+	return nil
+}
@@ -0,0 +1,161 @@
+package chord
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// receiver returns a node that is not started, its transfers are driven by calling the RPCs directly
+func receiver(t *testing.T) *Node {
+	options := testOptions(t, nil, t.TempDir(), 9400)
+	options.TransferTTL = time.Minute
+	node, err := NewNode(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.EncryptFlag = false
+	return node
+}
+
+func TestBeginTransferValidatesTheFile(t *testing.T) {
+	node := receiver(t)
+	id := func(name string) *big.Int { return new(big.Int).Mod(StrHash(name), node.HashMod) }
+	cases := []struct {
+		what string
+		file FileStructure
+	}{
+		{"no id", FileStructure{Name: "a.txt", Size: 1}},
+		{"no name", FileStructure{Id: id(""), Size: 1}},
+		{"a path", FileStructure{Id: id("../a.txt"), Name: "../a.txt", Size: 1}},
+		{"another id", FileStructure{Id: id("b.txt"), Name: "a.txt", Size: 1}},
+		{"a negative size", FileStructure{Id: id("a.txt"), Name: "a.txt", Size: -1}},
+	}
+	for _, c := range cases {
+		err := node.BeginTransferRPC(BeginTransferRPCArgs{File: c.file, Sender: "s"}, &BeginTransferRPCReply{})
+		if err == nil {
+			t.Errorf("a file with %s is accepted", c.what)
+		}
+	}
+}
+
+func TestTransferOfTheSameFile(t *testing.T) {
+	node := receiver(t)
+	f := FileStructure{Id: StrHash("a.txt"), Name: "a.txt", Size: 4, Clock: VectorClock{"s": 1}}
+	args := BeginTransferRPCArgs{File: f, Sender: "s"}
+	first := BeginTransferRPCReply{}
+	if err := node.BeginTransferRPC(args, &first); err != nil {
+		t.Fatal(err)
+	}
+	chunk := func(transferId string, data string) error {
+		return node.StoreChunkRPC(StoreChunkRPCArgs{TransferId: transferId, Data: []byte(data), Checksum: checksum(data)}, &StoreChunkRPCReply{})
+	}
+	if err := chunk(first.TransferId, "ab"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second send of the same file does not overwrite the one in progress
+	if err := node.BeginTransferRPC(args, &BeginTransferRPCReply{}); err == nil {
+		t.Fatal("a second send of a transfer in progress is accepted")
+	}
+
+	// once the first sender is idle, the second one resumes the transfer and the first one is refused
+	previous := node.transfers[first.TransferId]
+	previous.lastActive = time.Now().Add(-transferIdle)
+	second := BeginTransferRPCReply{}
+	if err := node.BeginTransferRPC(args, &second); err != nil {
+		t.Fatal(err)
+	}
+	if second.TransferId != first.TransferId || second.Offset != 2 {
+		t.Fatalf("the transfer is resumed at %d", second.Offset)
+	}
+	if !previous.abandoned {
+		t.Error("the chunks of the first sender are still accepted")
+	}
+	err := node.StoreChunkRPC(StoreChunkRPCArgs{TransferId: first.TransferId, Offset: 2, Data: []byte("cd"), Checksum: checksum("cd")}, &StoreChunkRPCReply{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSweepTransfers(t *testing.T) {
+	node := receiver(t)
+	f := FileStructure{Id: StrHash("a.txt"), Name: "a.txt", Size: 4, Clock: VectorClock{"s": 1}}
+	reply := BeginTransferRPCReply{}
+	if err := node.BeginTransferRPC(BeginTransferRPCArgs{File: f, Sender: "s"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	err := node.StoreChunkRPC(StoreChunkRPCArgs{TransferId: reply.TransferId, Data: []byte("ab"), Checksum: checksum("ab")}, &StoreChunkRPCReply{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a partial file left by a previous run of the node
+	leftover := node.transferPath("leftover")
+	if err := os.WriteFile(leftover, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * node.options.TransferTTL)
+	os.Chtimes(leftover, old, old)
+
+	if err := node.sweepTransfers(); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.transfers) != 1 {
+		t.Fatal("an active transfer is swept")
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error("the leftover partial file is kept")
+	}
+
+	node.transfers[reply.TransferId].lastActive = old
+	if err := node.sweepTransfers(); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.transfers) != 0 {
+		t.Fatal("an idle transfer is kept")
+	}
+	if _, err := os.Stat(node.transferPath(reply.TransferId)); !os.IsNotExist(err) {
+		t.Error("the partial file of the idle transfer is kept")
+	}
+	if err := node.CommitTransferRPC(reply.TransferId, &CommitTransferRPCReply{}); err == nil {
+		t.Error("a swept transfer is committed")
+	}
+}
+
+func checksum(data string) []byte {
+	sum := sha256.Sum256([]byte(data))
+	return sum[:]
+}
+
+func TestStoreTheSameVersionInBucketAndBackup(t *testing.T) {
+	node := receiver(t)
+	id := new(big.Int).Mod(StrHash("a.txt"), node.HashMod)
+	f := FileStructure{Id: id, Name: "a.txt", Size: 1, Clock: VectorClock{"s": 1}}
+	store := func(backUp bool) {
+		path := node.transferPath(strconv.FormatBool(backUp))
+		if err := os.WriteFile(path, []byte("a"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := node.storeFile(f, backUp, true, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.MkdirAll(node.nodeFolder()+"/transfer", os.ModePerm)
+
+	// the backup of the predecessor is stored first, then the node takes the file over as its owner
+	store(true)
+	store(false)
+	if !containsKey(node.Backup, id) || !containsKey(node.Bucket, id) {
+		t.Fatalf("the version is recorded in the bucket %v and the backup %v", node.Bucket, node.Backup)
+	}
+	if len(node.Siblings["a.txt"]) != 1 {
+		t.Errorf("the version is kept %d times", len(node.Siblings["a.txt"]))
+	}
+	content, err := os.ReadFile(node.siblingPath("a.txt", f.Clock))
+	if err != nil || string(content) != "a" {
+		t.Errorf("the version holds %q, %v", content, err)
+	}
+}
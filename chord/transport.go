@@ -0,0 +1,153 @@
+package chord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+	"time"
+)
+
+// Transport carries the RPCs between the nodes, every node has its own, see Options
+// TCPTransport is the jsonrpc over TCP used by default,
+// MemoryTransport connects the nodes running in the same process, e.g. in tests
+type Transport interface {
+	// Call invokes serviceMethod of the node at targetNodeAddr
+	Call(ctx context.Context, targetNodeAddr string, serviceMethod string, args interface{}, reply interface{}) error
+	// Listen serves the RPCs registered on server at addr, until the returned Closer is closed
+	Listen(addr string, server *rpc.Server) (io.Closer, error)
+	// ListenAddr returns the address to Listen at for a node that binds to bindAddr and is reached at advertiseAddr
+	ListenAddr(bindAddr string, advertiseAddr string) string
+	// Evict drops what is kept for the node at targetNodeAddr, e.g. when it is known to be dead
+	Evict(targetNodeAddr string)
+	// Close releases the resources of the transport
+	Close()
+}
+
+// ServeNode registers the RPCs of the node on its own server, and serves them on the transport at addr
+func ServeNode(transport Transport, node *Node, addr string) (io.Closer, error) {
+	server := rpc.NewServer()
+	err := server.RegisterName("Node", node)
+	if err != nil {
+		return nil, err
+	}
+	return transport.Listen(addr, server)
+}
+
+// TCPTransport is jsonrpc over TCP, with a pool of connections for every peer
+type TCPTransport struct {
+	*RPCClient
+}
+
+func NewTCPTransport(dialTimeout time.Duration, callTimeout time.Duration) *TCPTransport {
+	return &TCPTransport{NewRPCClient(dialTimeout, callTimeout)}
+}
+
+// ListenAddr returns bindAddr, the advertised address may belong to a NAT in front of the node
+func (t *TCPTransport) ListenAddr(bindAddr string, advertiseAddr string) string {
+	return bindAddr
+}
+
+func (t *TCPTransport) Listen(addr string, server *rpc.Server) (io.Closer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func(listener net.Listener) {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				fmt.Println("Accept failed:", err.Error())
+				continue
+			}
+			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}
+	}(listener)
+	return listener, nil
+}
+
+// MemoryTransport is an in-process network, every call goes through an in-memory pipe
+// the arguments and replies are still encoded with jsonrpc, as they are on TCP
+type MemoryTransport struct {
+	CallTimeout time.Duration
+
+	mutex   sync.RWMutex
+	servers map[string]*rpc.Server // the listening nodes by address
+}
+
+func NewMemoryTransport(callTimeout time.Duration) *MemoryTransport {
+	return &MemoryTransport{
+		CallTimeout: callTimeout,
+		servers:     make(map[string]*rpc.Server),
+	}
+}
+
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      string
+}
+
+// Close takes the node off the network, further calls to it fail as if it was dead
+func (l *memoryListener) Close() error {
+	l.transport.mutex.Lock()
+	defer l.transport.mutex.Unlock()
+	delete(l.transport.servers, l.addr)
+	return nil
+}
+
+// ListenAddr returns advertiseAddr, the in-memory network has no interfaces to bind to
+// and the other nodes reach the node by the address it advertises
+func (t *MemoryTransport) ListenAddr(bindAddr string, advertiseAddr string) string {
+	return advertiseAddr
+}
+
+func (t *MemoryTransport) Listen(addr string, server *rpc.Server) (io.Closer, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.servers[addr]; ok {
+		return nil, errors.New("address already in use: " + addr)
+	}
+	t.servers[addr] = server
+	return &memoryListener{transport: t, addr: addr}, nil
+}
+
+func (t *MemoryTransport) Call(ctx context.Context, targetNodeAddr string, serviceMethod string, args interface{}, reply interface{}) error {
+	t.mutex.RLock()
+	server, ok := t.servers[targetNodeAddr]
+	t.mutex.RUnlock()
+	if !ok {
+		return errors.New("dial memory " + targetNodeAddr + ": connection refused")
+	}
+	if t.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.CallTimeout)
+		defer cancel()
+	}
+
+	clientConn, serverConn := net.Pipe()
+	go server.ServeCodec(jsonrpc.NewServerCodec(serverConn))
+	client := jsonrpc.NewClient(clientConn)
+	defer client.Close()
+
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		// the reply is not written after we return
+		client.Close()
+		<-call.Done
+		return ctx.Err()
+	}
+}
+
+func (t *MemoryTransport) Evict(targetNodeAddr string) {}
+
+func (t *MemoryTransport) Close() {}
@@ -0,0 +1,101 @@
+package chord
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testOptions returns the default options with a transport, a port, a storage of the test and fast maintenance tasks
+// the nodes of a test share an in-memory network, a nil transport is the default TCP one
+func testOptions(t *testing.T, transport Transport, root string, port int) Options {
+	options := DefaultOptions()
+	options.Transport = transport
+	options.Port = port
+	options.StorageRoot = root
+	options.Ts = 50 * time.Millisecond
+	options.Tff = 20 * time.Millisecond
+	options.Tcp = 50 * time.Millisecond
+	options.Tae = 200 * time.Millisecond
+	options.Backoff = 1
+	return options
+}
+
+func startNode(t *testing.T, options Options, seeds ...string) *Node {
+	node, err := NewNode(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = node.Start(seeds...)
+	if err != nil {
+		t.Fatalf("node %s failed to start: %s", node.Addr, err)
+	}
+	return node
+}
+
+// waitFor fails the test if cond is still false after timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func successorOf(node *Node) string {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return node.SuccessorsAddr[0]
+}
+
+func TestMemoryTransportDefaultOptions(t *testing.T) {
+	network := NewMemoryTransport(2 * time.Second)
+	root := t.TempDir()
+
+	// the node binds to "localhost" and advertises "127.0.0.1", the other nodes reach it by the latter
+	first := startNode(t, testOptions(t, network, root, 9200))
+	defer first.Stop()
+	if first.Addr != "127.0.0.1:9200" {
+		t.Fatalf("the node advertises %s", first.Addr)
+	}
+	owner, err := first.Lookup("file.txt")
+	if err != nil || owner != first.Addr {
+		t.Fatalf("a node alone finds %q, %v", owner, err)
+	}
+
+	second := startNode(t, testOptions(t, network, root, 9201), first.Addr)
+	defer second.Stop()
+	waitFor(t, 5*time.Second, "the ring of two nodes", func() bool {
+		return successorOf(first) == second.Addr && successorOf(second) == first.Addr
+	})
+	for _, key := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+		a, errA := first.Lookup(key)
+		b, errB := second.Lookup(key)
+		if errA != nil || errB != nil || a != b {
+			t.Errorf("the nodes disagree on the owner of %s: %q %v, %q %v", key, a, errA, b, errB)
+		}
+	}
+}
+
+func TestTransportPerNode(t *testing.T) {
+	// two networks in the same process, the same address is taken once on each
+	root := t.TempDir()
+	first := startNode(t, testOptions(t, NewMemoryTransport(2*time.Second), root+"/a", 9210))
+	defer first.Stop()
+	second := startNode(t, testOptions(t, NewMemoryTransport(2*time.Second), root+"/b", 9210))
+	defer second.Stop()
+
+	// a seed on another network can not be reached
+	options := testOptions(t, NewMemoryTransport(2*time.Second), root+"/c", 9211)
+	options.JoinAttempts = 1
+	node, err := NewNode(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Start(first.Addr); !errors.Is(err, ErrNoSeedReachable) {
+		t.Fatal("the node joined through a seed on another network: ", err)
+	}
+}
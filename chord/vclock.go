@@ -0,0 +1,117 @@
+package chord
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VectorClock is the version of a file, it counts the writes of every node that wrote the file, keyed by node ID
+// a version descends the versions it was written over; two versions where neither descends the other were
+// written concurrently, both are kept as siblings until a write over both of them resolves the conflict
+type VectorClock map[string]uint64
+
+// Descends tells whether the clock has seen every write of other, a clock descends itself
+func (clock VectorClock) Descends(other VectorClock) bool {
+	for writer, count := range other {
+		if clock[writer] < count {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal tells whether the clocks are the same version
+func (clock VectorClock) Equal(other VectorClock) bool {
+	return clock.Descends(other) && other.Descends(clock)
+}
+
+// Concurrent tells whether neither clock descends the other, the versions are siblings
+func (clock VectorClock) Concurrent(other VectorClock) bool {
+	return !clock.Descends(other) && !other.Descends(clock)
+}
+
+// Merge returns the smallest clock that descends both clocks
+func (clock VectorClock) Merge(other VectorClock) VectorClock {
+	merged := make(VectorClock, len(clock))
+	for writer, count := range clock {
+		merged[writer] = count
+	}
+	for writer, count := range other {
+		if merged[writer] < count {
+			merged[writer] = count
+		}
+	}
+	return merged
+}
+
+// String returns the clock as "writer:count" pairs ordered by writer, the same for equal clocks
+func (clock VectorClock) String() string {
+	writers := make([]string, 0, len(clock))
+	for writer, count := range clock {
+		if count > 0 {
+			writers = append(writers, writer)
+		}
+	}
+	sort.Strings(writers)
+	pairs := make([]string, len(writers))
+	for i, writer := range writers {
+		pairs[i] = writer + ":" + strconv.FormatUint(clock[writer], 10)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// key returns a short name of the clock, the content of a sibling is stored in a file named after it
+func (clock VectorClock) key() string {
+	sum := sha1.Sum([]byte(clock.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// MergeClocks returns the clock that descends all the siblings, a write with it replaces them
+func MergeClocks(siblings []Sibling) VectorClock {
+	context := VectorClock{}
+	for _, sibling := range siblings {
+		context = context.Merge(sibling.Clock)
+	}
+	return context
+}
+
+// addSibling adds a version to the siblings of a file, the siblings that it descends are dropped and returned
+// nothing changes if one of the siblings already descends the version, added is false then
+func addSibling(siblings []VectorClock, clock VectorClock) (kept []VectorClock, dropped []VectorClock, added bool) {
+	for _, sibling := range siblings {
+		if sibling.Descends(clock) {
+			return siblings, nil, false
+		}
+	}
+	for _, sibling := range siblings {
+		if clock.Descends(sibling) {
+			dropped = append(dropped, sibling)
+		} else {
+			kept = append(kept, sibling)
+		}
+	}
+	return append(kept, clock), dropped, true
+}
+
+// hasSibling tells whether one of the siblings descends the version, the version is stored or obsolete then
+func hasSibling(siblings []VectorClock, clock VectorClock) bool {
+	for _, sibling := range siblings {
+		if sibling.Descends(clock) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasClock tells whether the clocks hold the version
+func hasClock(clocks []VectorClock, clock VectorClock) bool {
+	for _, c := range clocks {
+		if c.Equal(clock) {
+			return true
+		}
+	}
+	return false
+}
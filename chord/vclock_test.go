@@ -0,0 +1,92 @@
+package chord
+
+import "testing"
+
+func TestVectorClockOrder(t *testing.T) {
+	cases := []struct {
+		what       string
+		a, b       VectorClock
+		descends   bool // a descends b
+		equal      bool
+		concurrent bool
+	}{
+		{"equal clocks", VectorClock{"n1": 1, "n2": 2}, VectorClock{"n2": 2, "n1": 1}, true, true, false},
+		{"a zero count", VectorClock{"n1": 1, "n2": 0}, VectorClock{"n1": 1}, true, true, false},
+		{"a newer write", VectorClock{"n1": 2, "n2": 1}, VectorClock{"n1": 1, "n2": 1}, true, false, false},
+		{"a write of another node", VectorClock{"n1": 1, "n2": 1}, VectorClock{"n1": 1}, true, false, false},
+		{"a dominated clock", VectorClock{"n1": 1}, VectorClock{"n1": 2}, false, false, false},
+		{"concurrent writes", VectorClock{"n1": 2, "n2": 1}, VectorClock{"n1": 1, "n2": 2}, false, false, true},
+		{"writes of different nodes", VectorClock{"n1": 1}, VectorClock{"n2": 1}, false, false, true},
+	}
+	for _, c := range cases {
+		if got := c.a.Descends(c.b); got != c.descends {
+			t.Errorf("%s: Descends is %v", c.what, got)
+		}
+		if got := c.a.Equal(c.b); got != c.equal {
+			t.Errorf("%s: Equal is %v", c.what, got)
+		}
+		if got := c.a.Concurrent(c.b); got != c.concurrent {
+			t.Errorf("%s: Concurrent is %v", c.what, got)
+		}
+		if c.equal && c.a.String() != c.b.String() {
+			t.Errorf("%s: the equal clocks are %s and %s", c.what, c.a, c.b)
+		}
+	}
+}
+
+func TestAddSibling(t *testing.T) {
+	cases := []struct {
+		what     string
+		siblings []VectorClock
+		clock    VectorClock
+		kept     []VectorClock
+		dropped  []VectorClock
+		added    bool
+	}{
+		{"the first version", nil,
+			VectorClock{"n1": 1},
+			[]VectorClock{{"n1": 1}}, nil, true},
+		{"a newer version", []VectorClock{{"n1": 1}},
+			VectorClock{"n1": 2},
+			[]VectorClock{{"n1": 2}}, []VectorClock{{"n1": 1}}, true},
+		{"the same version", []VectorClock{{"n1": 1}},
+			VectorClock{"n1": 1},
+			[]VectorClock{{"n1": 1}}, nil, false},
+		{"a dominated version", []VectorClock{{"n1": 2}},
+			VectorClock{"n1": 1},
+			[]VectorClock{{"n1": 2}}, nil, false},
+		{"a concurrent version", []VectorClock{{"n1": 1}},
+			VectorClock{"n2": 1},
+			[]VectorClock{{"n1": 1}, {"n2": 1}}, nil, true},
+		{"a version over one of the siblings", []VectorClock{{"n1": 1}, {"n2": 1}},
+			VectorClock{"n1": 1, "n3": 1},
+			[]VectorClock{{"n2": 1}, {"n1": 1, "n3": 1}}, []VectorClock{{"n1": 1}}, true},
+		{"a version over all the siblings", []VectorClock{{"n1": 1}, {"n2": 1}},
+			VectorClock{"n1": 1, "n2": 1},
+			[]VectorClock{{"n1": 1, "n2": 1}}, []VectorClock{{"n1": 1}, {"n2": 1}}, true},
+	}
+	for _, c := range cases {
+		kept, dropped, added := addSibling(c.siblings, c.clock)
+		if added != c.added {
+			t.Errorf("%s: added is %v", c.what, added)
+		}
+		if !sameClocks(kept, c.kept) {
+			t.Errorf("%s: kept %v instead of %v", c.what, kept, c.kept)
+		}
+		if !sameClocks(dropped, c.dropped) {
+			t.Errorf("%s: dropped %v instead of %v", c.what, dropped, c.dropped)
+		}
+	}
+}
+
+func sameClocks(a, b []VectorClock) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,37 +1,21 @@
 package main
 
 import (
+	"Chord/chord"
 	"bufio"
-	"fmt"
+	"errors"
 	"log"
-	"net"
-	"net/rpc"
-	"net/rpc/jsonrpc"
 	"os"
 	"strings"
 	"time"
 )
 
-type ScheduledExecutor struct {
-	delay  time.Duration
-	ticker time.Ticker
-	quit   chan int
-}
-
-func (s *ScheduledExecutor) Start(task func()) {
-	s.ticker = *time.NewTicker(s.delay)
-	go func() {
-		for {
-			select {
-			case <-s.ticker.C:
-				go task()
-			case <-s.quit:
-				s.ticker.Stop()
-				return
-			}
-		}
-	}()
-}
+// the exit codes of the client
+const (
+	exitInvalidArguments = 1
+	exitJoinFailed       = 2 // a seed answered, but the node could not join the Chord
+	exitNoSeedReachable  = 3 // none of the seeds could be reached
+)
 
 func main() {
 	arguments := getComArgs()
@@ -40,124 +24,189 @@ func main() {
 	flag := validArguments(arguments)
 	if flag == -1 {
 		log.Println("[main] Arguments are invalid!")
-		os.Exit(1)
+		os.Exit(exitInvalidArguments)
 	} else {
 		log.Println("[main] Arguments are valid!")
-		node := NewNode(arguments)
-
-		IpAddress := fmt.Sprintf("%s:%d", arguments.IpAddress, arguments.Port)
-		addr, err := net.ResolveTCPAddr("tcp", IpAddress)
+		options := chord.DefaultOptions()
+		options.Transport = chord.NewTCPTransport(time.Duration(arguments.Tdial)*time.Millisecond, time.Duration(arguments.Tcall)*time.Millisecond)
+		options.IpAddress = arguments.IpAddress
+		options.Port = arguments.Port
+		options.AdvertiseIp = arguments.AdvertiseAddress
+		options.AdvertisePort = arguments.AdvertisePort
+		if arguments.NATFile != "" {
+			nat, err := chord.LoadNATFile(arguments.NATFile)
+			if err != nil {
+				log.Fatalln("[main] Failed to load the NAT file:", err.Error())
+			}
+			options.NAT = nat
+		}
+		options.Ts = time.Duration(arguments.Ts) * time.Millisecond
+		options.Tff = time.Duration(arguments.Tff) * time.Millisecond
+		options.Tcp = time.Duration(arguments.Tcp) * time.Millisecond
+		options.Tae = time.Duration(arguments.Tae) * time.Millisecond
+		options.R = arguments.R
+		options.Replicas = arguments.K
+		options.M = arguments.M
+		options.ClientName = arguments.ClientName
+		if arguments.ClientName != "default" {
+			options.Identifier, _ = chord.ParseIdentifier(arguments.ClientName)
+		}
+		options.LookupMode, _ = chord.ParseLookupMode(arguments.LookupMode)
+		options.ReadConsistency, _ = chord.ParseConsistency(arguments.ReadConsistency)
+		options.WriteConsistency, _ = chord.ParseConsistency(arguments.WriteConsistency)
+		node, err := chord.NewNode(options)
 		if err != nil {
-			log.Fatalln("ResolveTCPAddr failed:", err.Error())
+			log.Fatalln("[main] Failed to create the node:", err.Error())
 		}
-		rpc.Register(node)
-		listener, err := net.Listen("tcp", addr.String())
+		err = makeFolders(node)
 		if err != nil {
-			log.Fatalln("ListenTCP failed:", err.Error())
+			log.Fatalln("[main] Failed to create the upload and download folders:", err.Error())
 		}
-		defer listener.Close()
-
-		go func(listener net.Listener) {
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					fmt.Println("Accept failed:", err.Error())
-					continue
-				}
-				go jsonrpc.ServeConn(conn)
-			}
-		}(listener)
 
+		var seeds []string
 		if flag == 0 {
 			// Join the existing chord
-			remoteAddress := fmt.Sprintf("%s:%d", arguments.JoinAddress, arguments.JoinPort)
-			node.joinChord(remoteAddress)
-		} else if flag == 1 {
-			// Create new chord
-			node.createNewChord()
+			seeds, _ = joinSeeds(arguments)
 		}
-
-		executorStabilization := ScheduledExecutor{
-			delay: time.Duration(arguments.Ts) * time.Millisecond,
-			quit:  make(chan int),
-		}
-		executorStabilization.Start(func() {
-			node.stabilize()
-		})
-
-		executorFixFinger := ScheduledExecutor{
-			delay: time.Duration(arguments.Tff) * time.Millisecond,
-			quit:  make(chan int),
-		}
-		executorFixFinger.Start(func() {
-			node.FixFingers()
-		})
-
-		executorCheckPredecessor := ScheduledExecutor{
-			delay: time.Duration(arguments.Tcp) * time.Millisecond,
-			quit:  make(chan int),
+		err = node.Start(seeds...)
+		if errors.Is(err, chord.ErrNoSeedReachable) {
+			log.Println("[main] Failed to join the Chord, no seed is reachable:", err.Error())
+			os.Exit(exitNoSeedReachable)
+		} else if err != nil {
+			log.Println("[main] Failed to join the Chord:", err.Error())
+			os.Exit(exitJoinFailed)
 		}
-		executorCheckPredecessor.Start(func() {
-			node.checkPredecessor()
-		})
 
 		// Read input from stdin
 		reader := bufio.NewReader(os.Stdin)
 		for {
-			log.Println("Please enter your command(Lookup/StoreFile/PrintState/Quit)...")
-			command, _ := reader.ReadString('\n')
-			command = strings.ToUpper(strings.TrimSpace(command))
+			log.Println("Please enter your command(Lookup/Trace/StoreFile/Get/Delete/PrintState/Quit)...")
+			line, _ := reader.ReadString('\n')
+			// the key of TRACE, or the consistency level of STOREFILE and GET, may follow the command on the same line
+			command, key, _ := strings.Cut(strings.TrimSpace(line), " ")
+			command = strings.ToUpper(command)
+			key = strings.TrimSpace(key)
 			if command == "LOOKUP" {
 				log.Println("Please enter the file you want to look up...")
 				fileName, _ := reader.ReadString('\n')
 				fileName = strings.TrimSpace(fileName)
-				// hash this fila name to m-digits number
-				key := StrHash(fileName)
-				targetAddr := Lookup(key, node.Addr)
+				trace, err := node.Trace(fileName)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				targetAddr := trace.Successor
 				log.Println("The node that could has the required data: ", targetAddr)
 
 				// check if the file exists in targetAddr
-				checkFileExistRPCReply := CheckFileExistRPCReply{}
-				err = ChordCall(targetAddr, "Node.CheckFileExistRPC", fileName, &checkFileExistRPCReply)
+				checkFileExistRPCReply := chord.CheckFileExistRPCReply{}
+				err = node.Call(targetAddr, "Node.CheckFileExistRPC", fileName, &checkFileExistRPCReply)
 				if err != nil {
 					log.Println("Check file exist fail..", err)
 					continue
 				} else {
 					if checkFileExistRPCReply.Exist {
-						var getAddrRPCReply GetAddrRPCReply
-						err = ChordCall(targetAddr, "Node.GetAddrRPC", "", &getAddrRPCReply)
-						if err != nil {
-							log.Println("Chord Call failed! ")
-							continue
-						} else {
-							id := StrHash(targetAddr)
-							id.Mod(id, hashMod)
-							log.Printf("The file is stored at node: %d ,address:port is :%s\n", id, targetAddr)
-						}
+						log.Printf("The file is stored at node: %d ,address:port is :%s\n", trace.SuccessorId, targetAddr)
 					} else {
 						log.Println("The file is not stored at this node: ", targetAddr)
 					}
 				}
+			} else if command == "TRACE" {
+				if key == "" {
+					log.Println("Please enter the key you want to trace...")
+					key, _ = reader.ReadString('\n')
+					key = strings.TrimSpace(key)
+				}
+				trace, err := node.Trace(key)
+				log.Printf("The %s lookup of %s (id %d) took %d hops in %s\n", trace.Mode, key, trace.Id, len(trace.Hops), trace.Duration)
+				for i, hop := range trace.Hops {
+					if hop.Error != "" {
+						log.Printf("Hop %d: node %d, address: %s, latency: %s, error: %s\n", i+1, hop.Id, hop.Addr, hop.Latency, hop.Error)
+					} else {
+						log.Printf("Hop %d: node %d, address: %s, latency: %s\n", i+1, hop.Id, hop.Addr, hop.Latency)
+					}
+				}
+				if err != nil {
+					log.Println(err)
+				} else {
+					log.Println("The node responsible for the key: ", trace.Successor)
+				}
 			} else if command == "STOREFILE" {
+				consistency := options.WriteConsistency
+				if key != "" {
+					consistency, err = chord.ParseConsistency(key)
+					if err != nil {
+						log.Println(err)
+						continue
+					}
+				}
 				log.Println("Please enter the file you want to upload...")
 				fileName, _ := reader.ReadString('\n')
 				fileName = strings.TrimSpace(fileName)
-				err = StoreFile(fileName, node)
+				file, err := os.Open(uploadPath(node, fileName))
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				acks, err := node.PutWithConsistency(fileName, file, consistency)
+				file.Close()
+				if err != nil {
+					log.Println(err)
+				} else {
+					log.Printf("File storage success! %d copies acknowledged the %s write\n", acks, consistency)
+				}
+
+			} else if command == "GET" {
+				consistency := options.ReadConsistency
+				if key != "" {
+					consistency, err = chord.ParseConsistency(key)
+					if err != nil {
+						log.Println(err)
+						continue
+					}
+				}
+				log.Println("Please enter the file you want to download...")
+				fileName, _ := reader.ReadString('\n')
+				fileName = strings.TrimSpace(fileName)
+				siblings, acks, err := node.GetSiblings(fileName, consistency)
+				if err == nil {
+					var paths []string
+					paths, err = saveSiblings(node, fileName, siblings)
+					if err == nil && len(siblings) > 1 {
+						// the next STOREFILE of the file replaces all of them
+						log.Printf("The file has %d concurrent versions, store the merged file to resolve the conflict:\n", len(siblings))
+						for i, sibling := range siblings {
+							log.Printf("Version %s: %s\n", sibling.Clock, paths[i])
+						}
+					}
+				}
 				if err != nil {
 					log.Println(err)
 				} else {
-					log.Println("File storage success!")
+					log.Printf("File download success! %d copies answered the %s read\n", acks, consistency)
+				}
+
+			} else if command == "DELETE" {
+				log.Println("Please enter the file you want to delete...")
+				fileName, _ := reader.ReadString('\n')
+				fileName = strings.TrimSpace(fileName)
+				err = node.Delete(fileName)
+				if err != nil {
+					log.Println(err)
+				} else {
+					log.Println("File deletion success!")
 				}
 
 			} else if command == "PRINTSTATE" {
 				node.PrintState()
 			} else if command == "QUIT" {
-				executorStabilization.quit <- 1
-				executorFixFinger.quit <- 1
-				executorCheckPredecessor.quit <- 1
+				err = node.Stop()
+				if err != nil {
+					log.Println("[main] Failed to leave the Chord gracefully:", err.Error())
+				}
 				os.Exit(0)
 			} else {
-				log.Println("Invalid command! Please enter your command again(Lookup/StoreFile/PrintState/Quit)...")
+				log.Println("Invalid command! Please enter your command again(Lookup/Trace/StoreFile/Get/Delete/PrintState/Quit)...")
 			}
 		}
 	}
@@ -1,74 +1,121 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha1"
-	"crypto/x509"
-	"encoding/json"
-	"encoding/pem"
+	"Chord/chord"
+	"errors"
 	"flag"
-	"fmt"
-	"io"
 	"log"
-	"math/big"
 	"net"
-	"net/http"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Arguments struct {
-	IpAddress   string //The IP address that the Chord client will bind to.
-	Port        int    //The port that the Chord client will bind to and listen on. Represented as a base-10 integer. Must be specified.
-	JoinAddress string //The IP address of the machine running a Chord node
-	JoinPort    int    //The port that an existing Chord node is bound to and listening on
-	Ts          int    //The time in milliseconds between invocations of ‘stabilize’.
-	Tff         int    //The time in milliseconds between invocations of ‘fix fingers’
-	Tcp         int    //The time in milliseconds between invocations of ‘check predecessor’
-	R           int    //The number of successors maintained by the Chord client.
-	ClientName  string //The identifier (ID) assigned to the Chord client which will override the ID computed by the SHA1 sum of the client’s IP address and port number.
+	IpAddress        string //The IP address or host name that the Chord client will bind to, IPv6 literals may be bracketed.
+	Port             int    //The port that the Chord client will bind to and listen on. Represented as a base-10 integer. Must be specified.
+	AdvertiseAddress string //The IP address or host name that the other nodes use to reach the Chord client, empty to derive it from the bound address.
+	AdvertisePort    int    //The port that the other nodes use to reach the Chord client, 0 to use the bound port.
+	NATFile          string //The file of the static mapping from private to public addresses, empty if there is none.
+	JoinAddress      string //The IP address or host name of the machine running a Chord node
+	JoinPort         int    //The port that an existing Chord node is bound to and listening on
+	Seeds            string //More Chord nodes to join through, comma-separated host:port, tried after the joining node.
+	SeedFile         string //The file of more Chord nodes to join through, one host:port per line.
+	Ts               int    //The time in milliseconds between invocations of ‘stabilize’.
+	Tff              int    //The time in milliseconds between invocations of ‘fix fingers’
+	Tcp              int    //The time in milliseconds between invocations of ‘check predecessor’
+	Tae              int    //The time in milliseconds between invocations of ‘anti-entropy’, which repairs the backups of the successors.
+	R                int    //The number of successors maintained by the Chord client.
+	K                int    //The number of successors holding a backup of every file, at most R.
+	Tdial            int    //The time in milliseconds to wait for a connection to another node.
+	Tcall            int    //The time in milliseconds to wait for the reply of another node.
+	M                int    //The identifier bit-width of the Chord ring, the ring holds 2^M identifiers.
+	LookupMode       string //How the Chord client finds the successor of a key, "recursive" or "iterative".
+	ReadConsistency  string //How many copies of a file GET waits for, "ONE", "QUORUM" or "ALL".
+	WriteConsistency string //How many copies of a file STOREFILE waits for, "ONE", "QUORUM" or "ALL".
+	ClientName       string //The identifier (ID) assigned to the Chord client which will override the ID computed by the SHA1 sum of the client’s IP address and port number, 40 hex digits.
 }
 
 func getComArgs() Arguments {
 	// Read command line arguments
-	var a string  // Current node address
-	var p int     // Current node port
-	var ja string // Joining node address
-	var jp int    // Joining node port
-	var ts int    // The time in milliseconds between invocations of stabilize.
-	var tff int   // The time in milliseconds between invocations of fix_fingers.
-	var tcp int   // The time in milliseconds between invocations of check_predecessor.
-	var r int     // The number of successors to maintain.
-	var i string  // Client name
+	var a string     // Current node address
+	var p int        // Current node port
+	var aa string    // Advertised node address
+	var ap int       // Advertised node port
+	var nat string   // NAT mapping file
+	var ja string    // Joining node address
+	var jp int       // Joining node port
+	var seeds string // More joining nodes
+	var sf string    // Joining nodes file
+	var ts int       // The time in milliseconds between invocations of stabilize.
+	var tff int      // The time in milliseconds between invocations of fix_fingers.
+	var tcp int      // The time in milliseconds between invocations of check_predecessor.
+	var tae int      // The time in milliseconds between invocations of anti_entropy.
+	var r int        // The number of successors to maintain.
+	var k int        // The replication factor.
+	var td int       // The time in milliseconds to wait for a connection.
+	var tc int       // The time in milliseconds to wait for a reply.
+	var m int        // The identifier bit-width of the ring.
+	var lm string    // The lookup mode.
+	var rc string    // The read consistency level.
+	var wc string    // The write consistency level.
+	var i string     // Client name
 
-	flag.StringVar(&a, "a", "localhost", "current ip address")
+	flag.StringVar(&a, "a", "localhost", "current ip address or host name")
 	flag.IntVar(&p, "p", 8080, "current port")
-	flag.StringVar(&ja, "ja", "Null", "joining node address")
+	flag.StringVar(&aa, "aa", "", "the ip address or host name advertised to the other nodes, derived from -a if empty")
+	flag.IntVar(&ap, "ap", 0, "the port advertised to the other nodes, -p if 0")
+	flag.StringVar(&nat, "nat", "", "the file mapping private addresses to public ones, one \"private public\" pair per line")
+	flag.StringVar(&ja, "ja", "Null", "joining node ip address or host name")
 	flag.IntVar(&jp, "jp", 8081, "joining node port")
+	flag.StringVar(&seeds, "seeds", "", "more joining nodes, comma-separated host:port, tried in order after -ja")
+	flag.StringVar(&sf, "sf", "", "the file of more joining nodes, one host:port per line, tried after -seeds")
 	flag.IntVar(&ts, "ts", 3000, "the time in milliseconds between invocations of stabilize")
 	flag.IntVar(&tff, "tff", 3000, "The time in milliseconds between invocations of fix_fingers.")
 	flag.IntVar(&tcp, "tcp", 100, "The time in milliseconds between invocations of check_predecessor")
+	flag.IntVar(&tae, "tae", 3000, "The time in milliseconds between invocations of anti_entropy")
 	flag.IntVar(&r, "r", 3, "The number of successors to maintain")
-	flag.StringVar(&i, "i", "default", "Client name")
+	flag.IntVar(&k, "k", 1, "The number of successors holding a backup of every file, at most r")
+	flag.IntVar(&td, "td", int(chord.DefaultDialTimeout/time.Millisecond), "The time in milliseconds to wait for a connection to another node")
+	flag.IntVar(&tc, "tc", int(chord.DefaultCallTimeout/time.Millisecond), "The time in milliseconds to wait for the reply of another node")
+	flag.IntVar(&m, "m", 6, "The identifier bit-width of the chord ring, at most 160")
+	flag.StringVar(&lm, "lm", "recursive", "The lookup mode, recursive or iterative")
+	flag.StringVar(&rc, "rc", "ONE", "The number of copies GET waits for, ONE, QUORUM or ALL of the k+1 copies")
+	flag.StringVar(&wc, "wc", "ONE", "The number of copies STOREFILE waits for, ONE, QUORUM or ALL of the k+1 copies")
+	flag.StringVar(&i, "i", "default", "The identifier of the client, 40 hex digits")
 	flag.Parse()
 
 	return Arguments{
-		IpAddress:   a,
-		Port:        p,
-		JoinAddress: ja,
-		JoinPort:    jp,
-		Ts:          ts,
-		Tff:         tff,
-		Tcp:         tcp,
-		R:           r,
-		ClientName:  i,
+		IpAddress:        unbracket(a),
+		Port:             p,
+		AdvertiseAddress: unbracket(aa),
+		AdvertisePort:    ap,
+		NATFile:          nat,
+		JoinAddress:      unbracket(ja),
+		JoinPort:         jp,
+		Seeds:            seeds,
+		SeedFile:         sf,
+		Ts:               ts,
+		Tff:              tff,
+		Tcp:              tcp,
+		Tae:              tae,
+		R:                r,
+		K:                k,
+		Tdial:            td,
+		Tcall:            tc,
+		M:                m,
+		LookupMode:       lm,
+		ReadConsistency:  rc,
+		WriteConsistency: wc,
+		ClientName:       i,
 	}
 
 }
 
 func validArguments(args Arguments) int {
-	if net.ParseIP(args.IpAddress) == nil && args.IpAddress != "localhost" {
+	if !validHost(args.IpAddress) {
 		log.Println("Ip address is invalid!")
 		return -1
 	}
@@ -76,6 +123,14 @@ func validArguments(args Arguments) int {
 		log.Println("Port number is invalid")
 		return -1
 	}
+	if args.AdvertiseAddress != "" && !validHost(args.AdvertiseAddress) {
+		log.Println("Advertised address is invalid")
+		return -1
+	}
+	if args.AdvertisePort != 0 && (args.AdvertisePort < 1 || args.AdvertisePort > 65535) {
+		log.Println("Advertised port number is invalid")
+		return -1
+	}
 	// Check if durations are valid
 	if args.Ts < 1 || args.Ts > 60000 {
 		log.Println("Stabilize time is invalid")
@@ -89,6 +144,19 @@ func validArguments(args Arguments) int {
 		log.Println("CheckPred time is invalid")
 		return -1
 	}
+	if args.Tae < 1 || args.Tae > 60000 {
+		log.Println("AntiEntropy time is invalid")
+		return -1
+	}
+
+	if args.Tdial < 1 || args.Tdial > 60000 {
+		log.Println("Dial timeout is invalid")
+		return -1
+	}
+	if args.Tcall < 1 || args.Tcall > 60000 {
+		log.Println("Call timeout is invalid")
+		return -1
+	}
 
 	// Check if number of successors is valid
 	if args.R < 1 || args.R > 32 {
@@ -96,10 +164,37 @@ func validArguments(args Arguments) int {
 		return -1
 	}
 
+	// Check if replication factor is valid
+	if args.K < 1 || args.K > args.R {
+		log.Println("Replication factor is invalid")
+		return -1
+	}
+
+	// Check if identifier bit-width fits in the SHA-1 digest
+	if args.M < 1 || args.M > chord.MaxIdentifierBits {
+		log.Println("Identifier bit-width is invalid")
+		return -1
+	}
+
+	// Check if lookup mode is known
+	if _, err := chord.ParseLookupMode(args.LookupMode); err != nil {
+		log.Println("Lookup mode is invalid")
+		return -1
+	}
+
+	// Check if consistency levels are known
+	if _, err := chord.ParseConsistency(args.ReadConsistency); err != nil {
+		log.Println("Read consistency level is invalid")
+		return -1
+	}
+	if _, err := chord.ParseConsistency(args.WriteConsistency); err != nil {
+		log.Println("Write consistency level is invalid")
+		return -1
+	}
+
 	// Check if client name is s a valid string matching the regular expression [0-9a-fA-F]{40}
 	if args.ClientName != "default" {
-		matched, err := regexp.MatchString("[0-9a-fA-F]*", args.ClientName)
-		if err != nil || !matched {
+		if _, err := chord.ParseIdentifier(args.ClientName); err != nil {
 			log.Println("Client Name is invalid")
 			return -1
 		}
@@ -108,18 +203,24 @@ func validArguments(args Arguments) int {
 	// Check if joining address and port is valid or not
 	if args.JoinAddress != "Null" {
 		// Addr is specified, check if addr & port are valid
-		if net.ParseIP(args.JoinAddress) != nil || args.JoinAddress == "localhost" {
-			// Check if join port is valid
-			if args.JoinPort < 1024 || args.JoinPort > 65535 {
-				log.Println("Join port number is invalid")
-				return -1
-			}
-			// Join the chord ring
-			return 0
-		} else {
+		if !validHost(args.JoinAddress) {
 			log.Println("Joining address is invalid")
 			return -1
 		}
+		// Check if join port is valid
+		if args.JoinPort < 1024 || args.JoinPort > 65535 {
+			log.Println("Join port number is invalid")
+			return -1
+		}
+	}
+	seeds, err := joinSeeds(args)
+	if err != nil {
+		log.Println("Seed nodes are invalid:", err)
+		return -1
+	}
+	if len(seeds) > 0 {
+		// Join the chord ring
+		return 0
 	} else {
 		// Create a new chord ring
 		// ignore jp input
@@ -127,160 +228,98 @@ func validArguments(args Arguments) int {
 	}
 }
 
-// hash file name to m-digits number
-func StrHash(elt string) *big.Int {
-	hasher := sha1.New()
-	hasher.Write([]byte(elt))
-	return new(big.Int).SetBytes(hasher.Sum(nil))
-}
+// seedsEnv is the environment variable of more joining nodes, comma-separated host:port
+const seedsEnv = "CHORD_SEEDS"
 
-func between(start, elt, end *big.Int, inclusive bool) bool {
-	if end.Cmp(start) > 0 { // start < end
-		return (start.Cmp(elt) < 0 && elt.Cmp(end) < 0) || (inclusive && elt.Cmp(end) == 0)
-	} else {
-		return start.Cmp(elt) < 0 || elt.Cmp(end) < 0 || (inclusive && elt.Cmp(end) == 0)
+// joinSeeds returns the nodes to join the Chord through, in the order they are tried:
+// -ja/-jp, -seeds, the lines of the -sf file, then the CHORD_SEEDS environment variable
+func joinSeeds(args Arguments) ([]string, error) {
+	var seeds []string
+	if args.JoinAddress != "Null" {
+		seeds = append(seeds, net.JoinHostPort(args.JoinAddress, strconv.Itoa(args.JoinPort)))
 	}
-}
-
-type IP struct {
-	Query string
-}
-
-func getLocalAddress() string {
-	// get local ip address from dns server 8.8.8.8:80
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		log.Fatal(err)
+	seeds = append(seeds, strings.Split(args.Seeds, ",")...)
+	if args.SeedFile != "" {
+		content, err := os.ReadFile(args.SeedFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if comment := strings.Index(line, "#"); comment >= 0 {
+				line = line[:comment]
+			}
+			seeds = append(seeds, line)
+		}
 	}
-	defer conn.Close()
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String()
-}
+	seeds = append(seeds, strings.Split(os.Getenv(seedsEnv), ",")...)
 
-func (node *Node) genRSAKey(bits int) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
-	if err != nil {
-		log.Println("[genRSAKey] Failed to generate private key for node ", node.Name, "N"+node.Identifier.String())
+	var valid []string
+	for _, seed := range seeds {
+		seed = strings.TrimSpace(seed)
+		if seed == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(seed)
+		if err != nil {
+			return nil, err
+		}
+		portNumber, err := strconv.Atoi(port)
+		if !validHost(host) || err != nil || portNumber < 1 || portNumber > 65535 {
+			return nil, errors.New("seed " + seed + " is not a valid host:port")
+		}
+		valid = append(valid, seed)
 	}
-	node.PrivateKey = privateKey
-	node.PublicKey = &privateKey.PublicKey
+	return valid, nil
+}
 
-	//store private key in the node folder
-	privateKeyDER := x509.MarshalPKCS1PrivateKey(privateKey)
-	block := pem.Block{Type: "N" + node.Identifier.String() + "-private Key",
-		Headers: nil,
-		Bytes:   privateKeyDER}
-	nodeFolder := "../files/" + "N" + node.Identifier.String()
-	privateKeyFile, err := os.Create(nodeFolder + "/private.pem")
-	if err != nil {
-		log.Println("[genRSAKey] Failed to create private key file for node ", node.Name, "N"+node.Identifier.String())
-	}
-	defer privateKeyFile.Close()
-	err = pem.Encode(privateKeyFile, &block)
-	if err != nil {
-		log.Println("[genRSAKey] Failed to write private key into file")
-	}
+// hostPattern matches a DNS name, labels of letters, digits and hyphens separated by dots
+var hostPattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.?$`)
 
-	//store public kay in the node folder
-	publicKeyDER, err := x509.MarshalPKIXPublicKey(node.PublicKey)
-	if err != nil {
-		log.Println("[genRSAKey] Failed to get DER format of public key for node ", node.Name)
-	}
-	block = pem.Block{
-		Type:    "N" + node.Identifier.String() + "-public Key",
-		Headers: nil,
-		Bytes:   publicKeyDER,
-	}
-	publicKeyFile, err := os.Create(nodeFolder + "/public.pem")
-	if err != nil {
-		log.Println("[genRSAKey] Failed to create public key file for node ", node.Name)
-	}
-	defer publicKeyFile.Close()
-	err = pem.Encode(publicKeyFile, &block)
-	if err != nil {
-		log.Println("[genRSAKey] Failed to write public key into file")
+// validHost checks if host is an IPv4 or IPv6 address, or a DNS name like localhost
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
 	}
+	return len(host) <= 253 && hostPattern.MatchString(host)
 }
 
-// EncryptFile Encrypt file
-func (node *Node) EncryptFile(content []byte) []byte {
-	publicKey := node.PublicKey
-	encryptedContent, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, content)
-	if err != nil {
-		fmt.Println("Encrypt file failed")
-		return nil
+// unbracket removes the brackets around an IPv6 literal, e.g. [::1]
+func unbracket(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
 	}
-	// Return the encrypted file
-	return encryptedContent
+	return host
 }
 
-// DecryptFile Decrypt file
-func (node *Node) DecryptFile(content []byte) []byte {
-	privateKey := node.PrivateKey
-	decryptedContent, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, content)
-	if err != nil {
-		fmt.Println("Decrypt file failed")
-		return decryptedContent
+// the client stores the files of the upload folder of the node, and saves the files it gets into the download folder
+func makeFolders(node *chord.Node) error {
+	for _, folder := range []string{"/upload", "/download"} {
+		err := os.MkdirAll(node.Folder()+folder, os.ModePerm)
+		if err != nil {
+			return err
+		}
 	}
-	// Return the decrypted file
-	return decryptedContent
+	return nil
 }
 
-func NAT(addr string) string {
-	/*
-	* NAT: ip is internal ip, need to be changed to external ip
-	 */
-	new_addr := addr
-	getLocalAddress_res := getLocalAddress()
-	// fmt.Println("getLocalAddress_res: ", getLocalAddress_res)
-	// fmt.Println("Input addr: ", addr)
-	if addr == getLocalAddress_res {
-		new_addr = "localhost"
-	}
-
-	// wwq's NAT
-	if addr == "172.31.21.112" {
-		new_addr = "54.145.27.145"
-	}
-
-	// cfz's NAT
-	if addr == "192.168.31.236" {
-		new_addr = "95.80.36.91"
-	}
-
-	// jetson's NAT
-	if addr == "192.168.31.153" {
-		new_addr = "95.80.36.91"
-	}
-	// qi's laptop NAT
-	if addr == "192.168.254.89" {
-		new_addr = "50.93.222.140"
-	}
-
-	// qi's AWS NAT
-	if addr == "172.31.82.96" {
-		new_addr = "18.233.168.46"
-	}
-
-	return new_addr
+func uploadPath(node *chord.Node, fileName string) string {
+	return node.Folder() + "/upload/" + fileName
 }
 
-func getIP() string {
-	req, err := http.Get("http://ip-api.com/json/")
-	if err != nil {
-		fmt.Println("could not get ip")
-		return err.Error()
-	}
-	defer req.Body.Close()
-
-	body, err := io.ReadAll(req.Body)
-	if err != nil {
-		return err.Error()
+// saveSiblings saves a single version under the file name in the download folder, siblings as name.1, name.2, ...
+// and returns the paths they are saved at
+func saveSiblings(node *chord.Node, fileName string, siblings []chord.Sibling) ([]string, error) {
+	var paths []string
+	for i, sibling := range siblings {
+		path := node.Folder() + "/download/" + fileName
+		if len(siblings) > 1 {
+			path += "." + strconv.Itoa(i+1)
+		}
+		err := os.WriteFile(path, sibling.Content, 0644)
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, path)
 	}
-
-	var ip IP
-	//fmt.Println("body: ", string(body))
-	json.Unmarshal(body, &ip)
-
-	return ip.Query
+	return paths, nil
 }